@@ -25,6 +25,50 @@ type Codec interface {
 	Close() error
 }
 
+// Encoder is an optional Codec extension. Encode returns the frame the codec
+// would write for msg without writing it, so it must not touch the codec
+// stream and is safe to call concurrently with Send.
+type Encoder interface {
+	Protocol() Protocol
+	Encode(msg interface{}) ([]byte, error)
+}
+
+// PreEncoded is a frame encoded once by a codec of Protocol.
+// Codecs of the same Protocol write Frame straight out on Send.
+type PreEncoded struct {
+	Protocol Protocol
+	Frame    []byte
+}
+
+func PreEncode(codec Codec, msg interface{}) (*PreEncoded, error) {
+	encoder, ok := codec.(Encoder)
+	if !ok {
+		return nil, ErrNotEncoder
+	}
+	frame, err := encoder.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &PreEncoded{encoder.Protocol(), frame}, nil
+}
+
+// BatchCodec is an optional Codec extension, the async send loop enqueues
+// every queued message and writes them out with one Flush.
+type BatchCodec interface {
+	// Enqueue encodes msg into the write buffer without flushing it.
+	Enqueue(msg interface{}) error
+	// Buffered returns the number of bytes waiting to be flushed.
+	Buffered() int
+	Flush() error
+}
+
+// ReadBufferedCodec is an optional Codec extension for the event-driven mode.
+// ReadBuffered returns the number of received bytes the codec holds, a worker
+// keeps receiving while it is not 0 since epoll won't report them again.
+type ReadBufferedCodec interface {
+	ReadBuffered() int
+}
+
 type Handler interface {
 	HandleSession(*Session)
 }
@@ -49,9 +93,12 @@ func CreateCodec(dialer Dialer, protocol Protocol) (Codec, error) {
 }
 
 func CreateSession(conn net.Conn, protocol Protocol, sendChanSize int) (*Session, error) {
+	conn, meter := meterConn(conn)
 	codec, err := protocol.NewCodec(conn)
 	if err != nil {
 		return nil, err
 	}
-	return NewSession(codec, sendChanSize), nil
+	session := NewSession(codec, sendChanSize)
+	session.meter = meter
+	return session, nil
 }
@@ -0,0 +1,141 @@
+package link
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// BroadcastError reports a session that did not accept a broadcast message.
+// Err is SessionBlockedError when the session send channel was full.
+type BroadcastError struct {
+	SessionID uint64
+	Err       error
+}
+
+func (e BroadcastError) Error() string {
+	return fmt.Sprintf("session %d: %v", e.SessionID, e.Err)
+}
+
+type broadcastResult struct {
+	sync.Mutex
+	errs []BroadcastError
+}
+
+func (r *broadcastResult) add(sessionID uint64, err error) {
+	r.Lock()
+	r.errs = append(r.errs, BroadcastError{sessionID, err})
+	r.Unlock()
+}
+
+// encodeCache encodes a broadcast message once per Protocol. It is filled
+// before the shards are sent, so it needs no lock.
+type encodeCache struct {
+	msg    interface{}
+	frames map[Protocol]*PreEncoded
+}
+
+func newEncodeCache(msg interface{}) *encodeCache {
+	if _, ok := msg.(*PreEncoded); ok {
+		return &encodeCache{msg: msg}
+	}
+	return &encodeCache{msg: msg, frames: make(map[Protocol]*PreEncoded)}
+}
+
+func (cache *encodeCache) get(session *Session) interface{} {
+	encoder, ok := session.Codec().(Encoder)
+	if !ok || cache.frames == nil {
+		return cache.msg
+	}
+	protocol := encoder.Protocol()
+	if !reflect.TypeOf(protocol).Comparable() {
+		// can't be a map key
+		return cache.msg
+	}
+
+	pe, exists := cache.frames[protocol]
+	if !exists {
+		if frame, err := encoder.Encode(cache.msg); err == nil {
+			pe = &PreEncoded{protocol, frame}
+		}
+		cache.frames[protocol] = pe
+	}
+	if pe == nil {
+		return cache.msg
+	}
+	return pe
+}
+
+// broadcastSend is a session and the message it gets.
+type broadcastSend struct {
+	session *Session
+	msg     interface{}
+}
+
+// sendShards sends every shard in a goroutine of its own.
+func sendShards(shards [][]broadcastSend, result *broadcastResult) {
+	var wait sync.WaitGroup
+	for _, sends := range shards {
+		if len(sends) == 0 {
+			continue
+		}
+
+		wait.Add(1)
+		go func(sends []broadcastSend) {
+			defer wait.Done()
+			for _, send := range sends {
+				if err := send.session.Send(send.msg); err != nil {
+					result.add(send.session.id, err)
+				}
+			}
+		}(sends)
+	}
+	wait.Wait()
+}
+
+// Broadcast sends msg to every session accepted by filter, a nil filter accepts all sessions.
+// The message is encoded once per Protocol when the codec is an Encoder.
+// Shards are sent in parallel and no shard lock is held while sending.
+func (manager *Manager) Broadcast(msg interface{}, filter func(*Session) bool) []BroadcastError {
+	var result broadcastResult
+	cache := newEncodeCache(msg)
+	shards := make([][]broadcastSend, sessionMapNum)
+
+	for i := 0; i < sessionMapNum; i++ {
+		smap := &manager.sessionMaps[i]
+		smap.RLock()
+		sessions := make([]*Session, 0, len(smap.sessions))
+		for _, session := range smap.sessions {
+			sessions = append(sessions, session)
+		}
+		smap.RUnlock()
+
+		for _, session := range sessions {
+			if filter == nil || filter(session) {
+				shards[i] = append(shards[i], broadcastSend{session, cache.get(session)})
+			}
+		}
+	}
+
+	sendShards(shards, &result)
+	return result.errs
+}
+
+// Multicast sends msg to the given sessions, unknown IDs are reported with ErrSessionNotFound.
+func (manager *Manager) Multicast(ids []uint64, msg interface{}) []BroadcastError {
+	var result broadcastResult
+	cache := newEncodeCache(msg)
+	shards := make([][]broadcastSend, sessionMapNum)
+
+	for _, id := range ids {
+		session := manager.GetSession(id)
+		if session == nil {
+			result.add(id, ErrSessionNotFound)
+			continue
+		}
+		shards[id%sessionMapNum] = append(shards[id%sessionMapNum], broadcastSend{session, cache.get(session)})
+	}
+
+	sendShards(shards, &result)
+	return result.errs
+}
@@ -0,0 +1,92 @@
+package link
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func Test_Broadcast(t *testing.T) {
+	manager := NewManager()
+	streams := make(map[uint64]*bytes.Buffer)
+	for i := 0; i < 100; i++ {
+		var stream bytes.Buffer
+		session := manager.NewSession(&uint64Codec{rw: &stream}, 0)
+		streams[session.ID()] = &stream
+	}
+
+	var closed *Session
+	for _, session := range manager.GetSessions() {
+		closed = session
+		break
+	}
+	errs := manager.Broadcast(uint64(123), func(session *Session) bool {
+		if session == closed {
+			// closed between the shard snapshot and the send
+			session.Close()
+			return true
+		}
+		return session.ID()%2 == 0
+	})
+	if len(errs) != 1 || errs[0].SessionID != closed.ID() || errs[0].Err != SessionClosedError {
+		t.Fatalf("broadcast errors not match: %v", errs)
+	}
+
+	for id, stream := range streams {
+		if id == closed.ID() {
+			continue
+		}
+		if id%2 == 0 && stream.Len() != 8 || id%2 != 0 && stream.Len() != 0 {
+			t.Fatalf("session %d received %d bytes", id, stream.Len())
+		}
+	}
+
+	var ids []uint64
+	for id := range streams {
+		if id%2 != 0 && id != closed.ID() {
+			ids = append(ids, id)
+		}
+	}
+	errs = manager.Multicast(append(ids, 0), uint64(456))
+	if len(errs) != 1 || errs[0].SessionID != 0 || errs[0].Err != ErrSessionNotFound {
+		t.Fatalf("multicast errors not match: %v", errs)
+	}
+	for _, id := range ids {
+		if streams[id].Len() != 8 {
+			t.Fatalf("session %d received %d bytes", id, streams[id].Len())
+		}
+	}
+}
+
+// sliceProtocol can't be a map key.
+type sliceProtocol []string
+
+func (p sliceProtocol) NewCodec(rw io.ReadWriter) (Codec, error) {
+	return &sliceCodec{uint64Codec{rw}, p}, nil
+}
+
+type sliceCodec struct {
+	uint64Codec
+	p sliceProtocol
+}
+
+func (c *sliceCodec) Protocol() Protocol {
+	return c.p
+}
+
+func (c *sliceCodec) Encode(msg interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := (&uint64Codec{&buf}).Send(msg)
+	return buf.Bytes(), err
+}
+
+func Test_BroadcastNotComparable(t *testing.T) {
+	manager := NewManager()
+	var stream bytes.Buffer
+	codec, _ := sliceProtocol{"a"}.NewCodec(&stream)
+	manager.NewSession(codec, 0)
+
+	if errs := manager.Broadcast(uint64(123), nil); len(errs) != 0 || stream.Len() != 8 {
+		t.Fatalf("broadcast not sent: %v, %d", errs, stream.Len())
+	}
+}
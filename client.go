@@ -18,6 +18,8 @@
 
 package link
 
+import "time"
+
 type Client struct {
 	manager      *Manager
 
@@ -33,6 +35,14 @@ type Client struct {
 
 	sessions     chan *Session
 	isClosed     chan interface{}
+
+	resumeBuffer  int
+	resumeTimeout time.Duration
+
+	sendInterceptors    []SendInterceptor
+	receiveInterceptors []ReceiveInterceptor
+
+	errorHook     ErrorHook
 }
 
 func NewClient(d Dialer, p Protocol, MinSess, MaxSpeed uint64, sendChanSize int) *Client {
@@ -61,25 +71,108 @@ func (cli *Client) Serve(handler Handler) error {
 	for {
 		select {
 		case session := <-cli.sessions:
-			go handler.HandleSession(session)
+			go handleSession(handler, session, cli.errorHook)
 		case <-cli.isClosed:
 			return nil
 		}
 	}
 }
 
+// SetErrorHook sets the hook told about recovered handler panics.
+func (cli *Client) SetErrorHook(hook ErrorHook) {
+	cli.errorHook = hook
+}
+
 func (cli *Client) Stop() {
 	close(cli.isClosed)
 	cli.manager.Dispose()
 }
 
+// UseSend appends interceptors around every codec send of new sessions.
+func (cli *Client) UseSend(interceptors ...SendInterceptor) {
+	cli.sendInterceptors = append(cli.sendInterceptors, interceptors...)
+}
+
+// UseReceive appends interceptors around every codec receive of new sessions.
+func (cli *Client) UseReceive(interceptors ...ReceiveInterceptor) {
+	cli.receiveInterceptors = append(cli.receiveInterceptors, interceptors...)
+}
+
+// EnableResume makes new sessions resumable, see Server.EnableResume.
+// A dropped connection is redialed and the session is reattached within timeout.
+func (cli *Client) EnableResume(bufferSize int, timeout time.Duration) {
+	cli.resumeBuffer = bufferSize
+	cli.resumeTimeout = timeout
+}
+
+func (cli *Client) dialResume(token ResumeToken, received uint64, meter *byteMeter) (Codec, ResumeToken, uint64, error) {
+	conn, err := cli.dialer.Dial()
+	if err != nil {
+		return nil, token, 0, err
+	}
+
+	conn.SetDeadline(time.Now().Add(resumeHandshakeTimeout))
+	if err = writeResumeHandshake(conn, token, received); err != nil {
+		conn.Close()
+		return nil, token, 0, err
+	}
+	newToken, peerReceived, err := readResumeHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, token, 0, err
+	}
+	conn.SetDeadline(time.Time{})
+	if newToken == (ResumeToken{}) || (token != (ResumeToken{}) && newToken != token) {
+		conn.Close()
+		return nil, token, 0, ErrResumeRejected
+	}
+
+	codec, err := cli.protocol.NewCodec(&meteredConn{conn, meter})
+	if err != nil {
+		conn.Close()
+		return nil, token, 0, err
+	}
+	return codec, newToken, peerReceived, nil
+}
+
+func (cli *Client) createResumableSession() (*Session, error) {
+	meter := new(byteMeter)
+	codec, token, _, err := cli.dialResume(ResumeToken{}, 0, meter)
+	if err != nil {
+		return nil, err
+	}
+
+	redial := func(token ResumeToken, received uint64) (Codec, uint64, error) {
+		codec, _, peerReceived, err := cli.dialResume(token, received, meter)
+		return codec, peerReceived, err
+	}
+	resume := newSessionResume(codec, token, cli.resumeBuffer, cli.resumeTimeout, redial)
+	s := cli.manager.manage(newSession(codec, cli.sendChanSize, resume))
+	s.meter = meter
+	s.SetInterceptors(cli.sendInterceptors, cli.receiveInterceptors)
+	cli.sessions <- s
+	return s, nil
+}
+
 func (cli *Client) createSession() (*Session, error) {
-	codec, err := CreateCodec(cli.dialer, cli.protocol)
+	if cli.resumeTimeout > 0 {
+		return cli.createResumableSession()
+	}
+
+	conn, err := cli.dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	conn, meter := meterConn(conn)
+	codec, err := cli.protocol.NewCodec(conn)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
 	s := cli.manager.NewSession(codec, cli.sendChanSize)
+	s.meter = meter
+	s.SetInterceptors(cli.sendInterceptors, cli.receiveInterceptors)
 	cli.sessions <- s
 	return s, nil
 }
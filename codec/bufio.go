@@ -3,6 +3,8 @@ package codec
 import (
 	"bufio"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/FTwOoO/link"
 )
@@ -22,7 +24,7 @@ type bufioProtocol struct {
 }
 
 func (b *bufioProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
-	codec := new(bufioCodec)
+	codec := &bufioCodec{p: b}
 
 	if b.writeBuf > 0 {
 		codec.stream.w = bufio.NewWriterSize(rw, b.writeBuf)
@@ -37,7 +39,7 @@ func (b *bufioProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
 		codec.stream.Reader = rw
 	}
 
-	codec.stream.c, _ = rw.(io.Closer)
+	codec.stream.rw = rw
 
 	codec.base, err = b.base.NewCodec(&codec.stream)
 	if err != nil {
@@ -50,43 +52,109 @@ func (b *bufioProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
 type bufioStream struct {
 	io.Reader
 	io.Writer
-	c io.Closer
-	w *bufio.Writer
+	rw        io.ReadWriter
+	w         *bufio.Writer
+	closeOnce sync.Once
+	closeErr  error
 }
 
+// Flush goes on to a connection that buffers too, like the stream of a
+// wrapper while a handshake runs through it.
 func (s *bufioStream) Flush() error {
 	if s.w != nil {
-		return s.w.Flush()
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+	}
+	if f, ok := s.rw.(flusher); ok {
+		return f.Flush()
 	}
 	return nil
 }
 
-func (s *bufioStream) close() error {
-	if s.c != nil {
-		return s.c.Close()
+// SetDeadline reaches the connection, so a handshake of the base is limited in time.
+func (s *bufioStream) SetDeadline(t time.Time) error {
+	if d, ok := s.rw.(deadlineSetter); ok {
+		return d.SetDeadline(t)
 	}
-	return nil
+	return errNoDeadline
+}
+
+// Close closes the connection once, the base codec may close it before the bufio codec.
+func (s *bufioStream) Close() error {
+	s.closeOnce.Do(func() {
+		if c, ok := s.rw.(io.Closer); ok {
+			s.closeErr = c.Close()
+		}
+	})
+	return s.closeErr
 }
 
 type bufioCodec struct {
+	p      *bufioProtocol
 	base   link.Codec
 	stream bufioStream
 }
 
 func (c *bufioCodec) Send(msg interface{}) error {
-	if err := c.base.Send(msg); err != nil {
+	if err := c.Enqueue(msg); err != nil {
+		return err
+	}
+	return c.stream.Flush()
+}
+
+func (c *bufioCodec) Enqueue(msg interface{}) error {
+	if pe, ok := msg.(*link.PreEncoded); ok && pe.Protocol == c.p {
+		_, err := c.stream.Write(pe.Frame)
 		return err
 	}
+
+	// bufio doesn't change the framing, frames of the base protocol pass through
+	return c.base.Send(msg)
+}
+
+func (c *bufioCodec) Buffered() int {
+	if c.stream.w != nil {
+		return c.stream.w.Buffered()
+	}
+	return 0
+}
+
+func (c *bufioCodec) Flush() error {
 	return c.stream.Flush()
 }
 
+// ReadBuffered counts the read buffer and what the base codec buffered from it.
+func (c *bufioCodec) ReadBuffered() int {
+	n := 0
+	if r, ok := c.stream.Reader.(*bufio.Reader); ok {
+		n = r.Buffered()
+	}
+	if base, ok := c.base.(link.ReadBufferedCodec); ok {
+		n += base.ReadBuffered()
+	}
+	return n
+}
+
+func (c *bufioCodec) Protocol() link.Protocol {
+	return c.p
+}
+
+func (c *bufioCodec) Encode(msg interface{}) ([]byte, error) {
+	encoder, ok := c.base.(link.Encoder)
+	if !ok {
+		return nil, link.ErrNotEncoder
+	}
+	return encoder.Encode(msg)
+}
+
 func (c *bufioCodec) Receive() (interface{}, error) {
 	return c.base.Receive()
 }
 
 func (c *bufioCodec) Close() error {
 	err1 := c.base.Close()
-	err2 := c.stream.close()
+	err2 := c.stream.Close()
 	if err1 != nil {
 		return err1
 	}
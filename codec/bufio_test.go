@@ -1,10 +1,17 @@
 package codec
 
 import (
-	"encoding/binary"
 	"testing"
 )
 
 func Test_Bufio(t *testing.T) {
-	JsonTest(t, Bufio(FixLen(JsonTestProtocol(), 2, binary.LittleEndian, 64*1024, 64*1024), 1024, 1024))
+	JsonTest(t, Bufio(FixLenTestProtocol(t, 64*1024), 1024, 1024))
+}
+
+func Test_BufioPreEncoded(t *testing.T) {
+	PreEncodedTest(t, Bufio(FixLenTestProtocol(t, 64*1024), 1024, 1024))
+}
+
+func Test_BufioBatch(t *testing.T) {
+	BatchTest(t, Bufio(FixLenTestProtocol(t, 64*1024), 1024, 1024))
 }
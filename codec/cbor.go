@@ -0,0 +1,189 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+
+	"github.com/FTwOoO/link"
+	"github.com/fxamacker/cbor/v2"
+)
+
+const defaultCBORMaxMessage = 1 << 20
+
+// CBORLimits bound what a peer can make Receive allocate, 0 keeps the default.
+type CBORLimits struct {
+	// MaxNestedLevels of arrays, maps and tags, 32 by default.
+	MaxNestedLevels int
+	// MaxArrayElements and MaxMapPairs, 131072 by default.
+	MaxArrayElements int
+	MaxMapPairs      int
+	// MaxMessage is the most bytes Receive reads for a message, 1MB by default.
+	MaxMessage int
+}
+
+// CBORProtocol sends messages as CBOR data items in the core deterministic
+// encoding of RFC 8949, so the same message always has the same bytes and
+// can be signed. A registered type is sent with its tag and received as a
+// pointer to it.
+type CBORProtocol struct {
+	tags       cbor.TagSet
+	types      map[reflect.Type]uint64
+	encMode    cbor.EncMode
+	decMode    cbor.DecMode
+	maxMessage int
+}
+
+func CBOR() *CBORProtocol {
+	p := &CBORProtocol{
+		tags:  cbor.NewTagSet(),
+		types: make(map[reflect.Type]uint64),
+	}
+	// the modes share the tag set, later registrations are seen
+	p.encMode, _ = cbor.CoreDetEncOptions().EncModeWithSharedTags(p.tags)
+	p.SetLimits(CBORLimits{})
+	return p
+}
+
+// Register sends t with the CBOR tag, a number from the IANA registry or one
+// agreed on with the peer. Built in tags like 0 to 3 can't be registered.
+func (p *CBORProtocol) Register(tag uint64, t interface{}) error {
+	rt := reflect.TypeOf(t)
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	err := p.tags.Add(cbor.TagOptions{EncTag: cbor.EncTagRequired, DecTag: cbor.DecTagRequired}, rt, tag)
+	if err != nil {
+		return err
+	}
+	p.types[rt] = tag
+	return nil
+}
+
+// SetLimits sets the decoding limits of the codecs created afterwards.
+func (p *CBORProtocol) SetLimits(limits CBORLimits) error {
+	decMode, err := cbor.DecOptions{
+		MaxNestedLevels:  limits.MaxNestedLevels,
+		MaxArrayElements: limits.MaxArrayElements,
+		MaxMapPairs:      limits.MaxMapPairs,
+		// a signed message must not mean two things
+		DupMapKey: cbor.DupMapKeyEnforcedAPF,
+	}.DecModeWithSharedTags(p.tags)
+	if err != nil {
+		return err
+	}
+	p.decMode = decMode
+	p.maxMessage = limits.MaxMessage
+	if p.maxMessage <= 0 {
+		p.maxMessage = defaultCBORMaxMessage
+	}
+	return nil
+}
+
+// MessageTypes returns the registered types as Receive returns them, as pointers.
+func (p *CBORProtocol) MessageTypes() []reflect.Type {
+	types := make([]reflect.Type, 0, len(p.types))
+	for t := range p.types {
+		types = append(types, reflect.PtrTo(t))
+	}
+	return types
+}
+
+func (p *CBORProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	codec := &cborCodec{
+		p:          p,
+		w:          rw,
+		maxMessage: p.maxMessage,
+	}
+	codec.limit.r = rw
+	codec.decoder = p.decMode.NewDecoder(&codec.limit)
+	codec.encoder = p.encMode.NewEncoder(&codec.buf)
+	codec.closer, _ = rw.(io.Closer)
+	return codec, nil
+}
+
+// cborLimitReader fails a Decode that reads more than n bytes, the decoder
+// would otherwise buffer whatever length a peer claims.
+type cborLimitReader struct {
+	r io.Reader
+	n int
+}
+
+func (l *cborLimitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, ErrTooLargePacket
+	}
+	if len(p) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= n
+	return n, err
+}
+
+type cborCodec struct {
+	p          *CBORProtocol
+	w          io.Writer
+	closer     io.Closer
+	maxMessage int
+	limit      cborLimitReader
+	decoder    *cbor.Decoder
+	encoder    *cbor.Encoder
+	buf        bytes.Buffer
+}
+
+func (c *cborCodec) Receive() (interface{}, error) {
+	c.limit.n = c.maxMessage
+	var msg interface{}
+	if err := c.decoder.Decode(&msg); err != nil {
+		return nil, err
+	}
+	// the decoder sets tagged types as values
+	if t := reflect.TypeOf(msg); t != nil {
+		if _, registered := c.p.types[t]; registered {
+			ptr := reflect.New(t)
+			ptr.Elem().Set(reflect.ValueOf(msg))
+			return ptr.Interface(), nil
+		}
+	}
+	return msg, nil
+}
+
+func (c *cborCodec) Send(msg interface{}) error {
+	if pe, ok := msg.(*link.PreEncoded); ok {
+		if pe.Protocol != c.p {
+			return link.ErrPreEncodedMismatch
+		}
+		_, err := c.w.Write(pe.Frame)
+		return err
+	}
+
+	c.buf.Reset()
+	if err := c.encoder.Encode(msg); err != nil {
+		return err
+	}
+	_, err := c.w.Write(c.buf.Bytes())
+	return err
+}
+
+func (c *cborCodec) ReadBuffered() int {
+	if r, ok := c.decoder.Buffered().(interface{ Len() int }); ok {
+		return r.Len()
+	}
+	return 0
+}
+
+func (c *cborCodec) Protocol() link.Protocol {
+	return c.p
+}
+
+func (c *cborCodec) Encode(msg interface{}) ([]byte, error) {
+	return c.p.encMode.Marshal(msg)
+}
+
+func (c *cborCodec) Close() error {
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/FTwOoO/link"
+)
+
+func CBORTestProtocol() *CBORProtocol {
+	protocol := CBOR()
+	protocol.Register(1000, MyMessage1{})
+	protocol.Register(1001, &MyMessage2{})
+	return protocol
+}
+
+func CBORTest(t *testing.T, protocol link.Protocol) {
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+
+	sendMsg1 := MyMessage1{"abc", 123}
+	sendMsg2 := MyMessage2{123, "abc"}
+	codec.Send(&sendMsg1)
+	codec.Send(sendMsg2)
+	codec.Send(map[string]int{"a": 1})
+
+	recvMsg1, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *recvMsg1.(*MyMessage1) != sendMsg1 {
+		t.Fatalf("message not match: %v, %v", sendMsg1, recvMsg1)
+	}
+	recvMsg2, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *recvMsg2.(*MyMessage2) != sendMsg2 {
+		t.Fatalf("message not match: %v, %v", sendMsg2, recvMsg2)
+	}
+	recvMsg3, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recvMsg3.(map[interface{}]interface{})["a"] != uint64(1) {
+		t.Fatalf("map not match: %v", recvMsg3)
+	}
+}
+
+func Test_CBOR(t *testing.T) {
+	CBORTest(t, CBORTestProtocol())
+	PreEncodedTest(t, CBORTestProtocol())
+
+	framed, err := FixLen(CBORTestProtocol(), 2, binary.LittleEndian, 1024, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	CBORTest(t, framed)
+
+	if err := CBOR().Register(1, MyMessage1{}); err == nil {
+		t.Fatal("built in tag registered")
+	}
+}
+
+func Test_CBORDeterministic(t *testing.T) {
+	var stream bytes.Buffer
+	codec, _ := CBORTestProtocol().NewCodec(&stream)
+
+	m1 := map[string]int{}
+	m2 := map[string]int{}
+	for i := 0; i < 20; i++ {
+		m1[string(rune('a'+i))] = i
+		m2[string(rune('a'+19-i))] = 19 - i
+	}
+	frame1, _ := codec.(link.Encoder).Encode(m1)
+	frame2, _ := codec.(link.Encoder).Encode(m2)
+	if !bytes.Equal(frame1, frame2) {
+		t.Fatal("encoding not deterministic")
+	}
+
+	// tag 1000 in the shortest head, then the struct as a map
+	frame, _ := codec.(link.Encoder).Encode(&MyMessage1{"abc", 123})
+	if !bytes.HasPrefix(frame, []byte{0xd9, 0x03, 0xe8, 0xa2}) {
+		t.Fatalf("tagged message not match: %x", frame)
+	}
+}
+
+func Test_CBORLimits(t *testing.T) {
+	protocol := CBORTestProtocol()
+	if err := protocol.SetLimits(CBORLimits{MaxNestedLevels: 4, MaxMessage: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+	codec.Send([]interface{}{[]interface{}{[]interface{}{[]interface{}{[]interface{}{1}}}}})
+	if _, err := codec.Receive(); err == nil {
+		t.Fatal("nesting not limited")
+	}
+
+	stream.Reset()
+	codec, _ = protocol.NewCodec(&stream)
+	codec.Send(bytes.Repeat([]byte("x"), 1000))
+	if _, err := codec.Receive(); err != ErrTooLargePacket {
+		t.Fatalf("message size not limited: %v", err)
+	}
+
+	// a huge claimed length fails when the data ends
+	stream.Reset()
+	codec, _ = protocol.NewCodec(&stream)
+	stream.Write([]byte{0x5a, 0xff, 0xff, 0xff, 0xff})
+	if _, err := codec.Receive(); err == nil {
+		t.Fatal("truncated message accepted")
+	}
+
+	// a running codec keeps the limits it was created with
+	stream.Reset()
+	codec, _ = protocol.NewCodec(&stream)
+	protocol.SetLimits(CBORLimits{MaxMessage: 10})
+	codec.Send(bytes.Repeat([]byte("x"), 50))
+	if _, err := codec.Receive(); err != nil {
+		t.Fatalf("limits changed under a running codec: %v", err)
+	}
+}
@@ -0,0 +1,608 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/FTwOoO/link"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	ErrUnsupportedCompression = errors.New("Unsupported Compression")
+	ErrCompressConfig         = errors.New("Invalid Compress Config")
+)
+
+// CompressAlgorithm is the flag byte in front of each frame body.
+type CompressAlgorithm byte
+
+const (
+	// CompressNone marks a body sent as is, every codec accepts it.
+	CompressNone CompressAlgorithm = iota
+	CompressGzip
+	CompressDeflate
+	CompressSnappy
+	CompressZstd
+	// CompressStream is deflate over the whole connection: each frame is
+	// flushed but the window is kept, so small frames repeating earlier ones
+	// compress well. Both sides must set the same dictionary.
+	CompressStream
+
+	compressAlgorithms
+)
+
+const defaultCompressMaxFrame = 1 << 20
+
+// deflateTail ends every flush, the stream frames leave it out.
+var deflateTail = []byte{0, 0, 0xff, 0xff}
+
+type CompressProtocol struct {
+	base      link.Protocol
+	algo      CompressAlgorithm
+	threshold int
+	maxFrame  int
+	dict      []byte
+	negotiate []CompressAlgorithm
+	timeout   time.Duration
+	pool      BufferPool
+}
+
+// Compress frames messages of base as a varint length, the flag byte and the
+// body, which is compressed with algo when it is longer than threshold bytes.
+// Receive takes every algorithm unless SetNegotiate limits them.
+func Compress(base link.Protocol, algo CompressAlgorithm, threshold int) (*CompressProtocol, error) {
+	if algo >= compressAlgorithms {
+		return nil, ErrUnsupportedCompression
+	}
+	if threshold < 0 {
+		return nil, ErrCompressConfig
+	}
+	return &CompressProtocol{
+		base:      base,
+		algo:      algo,
+		threshold: threshold,
+		maxFrame:  defaultCompressMaxFrame,
+		pool:      DefaultPool,
+	}, nil
+}
+
+// SetMaxFrame limits the uncompressed body on both sides, a body inflating
+// past it fails with ErrTooLargePacket. The default is 1MB. Like the other
+// settings it applies to codecs created afterwards.
+func (p *CompressProtocol) SetMaxFrame(maxFrame int) {
+	p.maxFrame = maxFrame
+}
+
+// SetDictionary presets the CompressStream window with dict, usually a sample
+// of typical messages, so even the first frames compress well.
+func (p *CompressProtocol) SetDictionary(dict []byte) {
+	p.dict = dict
+}
+
+// SetNegotiate makes NewCodec exchange the accepted algorithms on the
+// connection before the first frame, so both sides must set it. A codec then
+// receives only the algorithms of accept and sends with the first of them the
+// peer accepts too, CompressNone when there is none. CompressStream is only
+// agreed on when both dictionaries are the same.
+func (p *CompressProtocol) SetNegotiate(accept ...CompressAlgorithm) error {
+	if len(accept) >= 256 {
+		return ErrCompressConfig
+	}
+	for _, algo := range accept {
+		if algo >= compressAlgorithms {
+			return ErrUnsupportedCompression
+		}
+	}
+	p.negotiate = append([]CompressAlgorithm{}, accept...)
+	return nil
+}
+
+// SetHandshakeTimeout limits the negotiation, DefaultHandshakeTimeout when 0.
+func (p *CompressProtocol) SetHandshakeTimeout(timeout time.Duration) {
+	p.timeout = timeout
+}
+
+func (p *CompressProtocol) SetPool(pool BufferPool) {
+	p.pool = pool
+}
+
+func (p *CompressProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	// the settings are copied, so changing them doesn't race with running codecs
+	codec := &compressCodec{
+		p:        p,
+		rw:       rw,
+		algo:     p.algo,
+		maxFrame: p.maxFrame,
+		dict:     p.dict,
+		offer:    p.negotiate,
+		timeout:  p.timeout,
+		pool:     p.pool,
+	}
+	for i := range codec.accept {
+		codec.accept[i], codec.peer[i] = true, true
+	}
+	codec.stream.pool = codec.pool
+	codec.byteReader, _ = rw.(io.ByteReader)
+
+	if codec.offer != nil {
+		if err = codec.negotiate(); err != nil {
+			return
+		}
+	}
+
+	codec.base, err = codec.stream.newBase(p.base, rw)
+	if err != nil {
+		return
+	}
+	cc = codec
+	return
+}
+
+// hello is the handshake: the number of accepted algorithms, the algorithms
+// and the CRC32 of the dictionary.
+func (c *compressCodec) hello() []byte {
+	b := make([]byte, 0, 1+len(c.offer)+4)
+	b = append(b, byte(len(c.offer)))
+	for _, algo := range c.offer {
+		b = append(b, byte(algo))
+	}
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(c.dict))
+}
+
+// compressBound is more than any algorithm makes of n bytes, it limits the
+// compressed frames read.
+func compressBound(n int) int {
+	return n + n/16 + 64
+}
+
+type compressCodec struct {
+	p          *CompressProtocol
+	base       link.Codec
+	rw         io.ReadWriter
+	byteReader io.ByteReader
+	head       [binary.MaxVarintLen64]byte
+	stream     fixlenReadWriter
+
+	maxFrame int
+	dict     []byte
+	offer    []CompressAlgorithm
+	timeout  time.Duration
+	pool     BufferPool
+
+	// algo is what Send uses, accept what Receive takes, peer what the other side takes
+	algo   CompressAlgorithm
+	accept [compressAlgorithms]bool
+	peer   [compressAlgorithms]bool
+
+	// CompressStream state, created with the first stream frame
+	deflater *flate.Writer
+	deflated appendWriter
+	inflater io.ReadCloser
+	inflated bytes.Buffer
+}
+
+func (c *compressCodec) negotiate() error {
+	var n [1]byte
+	var hello []byte
+	err := exchange(c.rw, c.hello(), c.timeout, func(r io.Reader) error {
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return err
+		}
+		hello = make([]byte, int(n[0])+4)
+		_, err := io.ReadFull(r, hello)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	sameDict := binary.BigEndian.Uint32(hello[n[0]:]) == crc32.ChecksumIEEE(c.dict)
+
+	c.accept, c.peer = [compressAlgorithms]bool{}, [compressAlgorithms]bool{}
+	c.accept[CompressNone], c.peer[CompressNone] = true, true
+	for _, algo := range c.offer {
+		c.accept[algo] = algo != CompressStream || sameDict
+	}
+	for _, b := range hello[:n[0]] {
+		if algo := CompressAlgorithm(b); algo < compressAlgorithms {
+			c.peer[algo] = algo != CompressStream || sameDict
+		}
+	}
+	c.algo = CompressNone
+	for _, algo := range c.offer {
+		if c.peer[algo] && c.accept[algo] {
+			c.algo = algo
+			break
+		}
+	}
+	return nil
+}
+
+// frame appends the frame of body to dst, compressed with algo when it is
+// longer than the threshold and gets smaller.
+func (c *compressCodec) frame(dst, body []byte, algo CompressAlgorithm) ([]byte, error) {
+	if len(body) > c.maxFrame {
+		return dst, ErrTooLargePacket
+	}
+	if len(body) <= c.p.threshold {
+		algo = CompressNone
+	}
+
+	// room for the length, it is moved next to the flag once known
+	start := len(dst)
+	dst = append(dst, make([]byte, binary.MaxVarintLen64)...)
+	flag := len(dst)
+	dst = append(dst, byte(algo))
+
+	var err error
+	compressed := false
+	switch algo {
+	case CompressNone:
+	case CompressStream:
+		// the window has moved on, the frame must go out compressed
+		dst, err = c.deflate(dst, body)
+		compressed = true
+	default:
+		dst, err = compressFrame(dst, body, algo)
+		compressed = len(dst)-flag-1 < len(body)
+	}
+	if err != nil {
+		return dst[:start], err
+	}
+	if !compressed {
+		dst = append(append(dst[:flag], byte(CompressNone)), body...)
+	}
+
+	var head [binary.MaxVarintLen64]byte
+	at := flag - binary.PutUvarint(head[:], uint64(len(dst)-flag))
+	copy(dst[at:], head[:flag-at])
+	n := copy(dst[start:], dst[at:])
+	return dst[:start+n], nil
+}
+
+// deflate appends the length of body and body compressed on the connection
+// stream to dst, without the tail of the flush.
+func (c *compressCodec) deflate(dst, body []byte) ([]byte, error) {
+	if c.deflater == nil {
+		// lower levels don't match across flushes
+		w, err := flate.NewWriterDict(&c.deflated, flate.BestCompression, c.dict)
+		if err != nil {
+			return dst, err
+		}
+		c.deflater = w
+	}
+
+	c.deflated.b = binary.AppendUvarint(dst, uint64(len(body)))
+	_, err := c.deflater.Write(body)
+	if err == nil {
+		err = c.deflater.Flush()
+	}
+	dst, c.deflated.b = c.deflated.b, nil
+	if err != nil {
+		return dst, err
+	}
+	return bytes.TrimSuffix(dst, deflateTail), nil
+}
+
+// inflate appends the body of a stream frame to dst. The deflate reader is
+// fed frame by frame and reads exactly the length sent, so it never waits for
+// the next frame.
+func (c *compressCodec) inflate(dst, src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		return dst, ErrInvalidLength
+	}
+	if size > uint64(c.maxFrame) {
+		return dst, ErrTooLargePacket
+	}
+	c.inflated.Write(src[n:])
+	c.inflated.Write(deflateTail)
+	if c.inflater == nil {
+		c.inflater = flate.NewReaderDict(&c.inflated, c.dict)
+	}
+
+	start := len(dst)
+	dst = append(dst, make([]byte, size)...)
+	_, err := io.ReadFull(c.inflater, dst[start:])
+	return dst, err
+}
+
+func (c *compressCodec) Receive() (interface{}, error) {
+	_, length, err := readUvarint(c.rw, c.byteReader, c.head[:])
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, ErrInvalidLength
+	}
+	if length > uint64(compressBound(c.maxFrame)) {
+		return nil, ErrTooLargePacket
+	}
+
+	// the base codec must not keep references to the frame
+	frame := c.pool.Get(int(length))
+	defer c.pool.Put(frame)
+	if _, err := io.ReadFull(c.rw, frame.B); err != nil {
+		return nil, err
+	}
+
+	algo, body := CompressAlgorithm(frame.B[0]), frame.B[1:]
+	if algo >= compressAlgorithms || !c.accept[algo] {
+		return nil, ErrUnsupportedCompression
+	}
+	if algo != CompressNone {
+		out := c.pool.Get(0)
+		defer c.pool.Put(out)
+		if algo == CompressStream {
+			out.B, err = c.inflate(out.B, body)
+		} else {
+			out.B, err = decompressFrame(out.B, body, algo, c.maxFrame)
+		}
+		if err != nil {
+			return nil, err
+		}
+		body = out.B
+	}
+
+	c.stream.recvBuf.Reset(body)
+	return c.base.Receive()
+}
+
+// frameAlgorithm returns the flag of an encoded frame.
+func frameAlgorithm(frame []byte) CompressAlgorithm {
+	_, n := binary.Uvarint(frame)
+	if n <= 0 || n >= len(frame) {
+		return compressAlgorithms
+	}
+	return CompressAlgorithm(frame[n])
+}
+
+func (c *compressCodec) Send(msg interface{}) error {
+	if pe, ok := msg.(*link.PreEncoded); ok {
+		if algo := frameAlgorithm(pe.Frame); pe.Protocol != c.p || algo >= compressAlgorithms || !c.peer[algo] {
+			return link.ErrPreEncodedMismatch
+		}
+		_, err := c.rw.Write(pe.Frame)
+		return err
+	}
+
+	c.stream.sendBuf = c.pool.Get(0)
+	defer func() {
+		c.pool.Put(c.stream.sendBuf)
+		c.stream.sendBuf = nil
+	}()
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+
+	frame := c.pool.Get(0)
+	defer c.pool.Put(frame)
+	var err error
+	if frame.B, err = c.frame(frame.B, c.stream.sendBuf.B, c.algo); err != nil {
+		return dropFrame(c.base, err)
+	}
+	_, err = c.rw.Write(frame.B)
+	return err
+}
+
+// ReadBuffered is what the base codec holds, a frame is read whole and
+// always gives the base exactly one message.
+func (c *compressCodec) ReadBuffered() int {
+	if base, ok := c.base.(link.ReadBufferedCodec); ok {
+		return base.ReadBuffered()
+	}
+	return 0
+}
+
+func (c *compressCodec) Protocol() link.Protocol {
+	return c.p
+}
+
+// Encode compresses with the algorithm of the protocol, the frame of a
+// CompressStream protocol is not compressed since the window belongs to
+// one connection.
+func (c *compressCodec) Encode(msg interface{}) ([]byte, error) {
+	encoder, ok := c.base.(link.Encoder)
+	if !ok {
+		return nil, link.ErrNotEncoder
+	}
+	body, err := encoder.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	algo := c.p.algo
+	if algo == CompressStream {
+		algo = CompressNone
+	}
+	return c.frame(nil, body, algo)
+}
+
+func (c *compressCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type appendWriter struct {
+	b []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+type resetWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// pooledWriter is a gzip or deflate writer appending to the slice it is given.
+type pooledWriter struct {
+	out appendWriter
+	w   resetWriter
+}
+
+func (p *pooledWriter) compress(dst, src []byte) ([]byte, error) {
+	p.out.b = dst
+	p.w.Reset(&p.out)
+	_, err := p.w.Write(src)
+	if err == nil {
+		err = p.w.Close()
+	}
+	dst, p.out.b = p.out.b, nil
+	return dst, err
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	p := &pooledWriter{}
+	p.w = gzip.NewWriter(&p.out)
+	return p
+}}
+
+var flateWriters = sync.Pool{New: func() interface{} {
+	p := &pooledWriter{}
+	p.w, _ = flate.NewWriter(&p.out, flate.DefaultCompression)
+	return p
+}}
+
+// pooledReader decompresses gzip or deflate frames.
+type pooledReader struct {
+	in    bytes.Reader
+	gzip  gzip.Reader
+	flate io.ReadCloser
+}
+
+var frameReaders = sync.Pool{New: func() interface{} {
+	return &pooledReader{}
+}}
+
+func (p *pooledReader) decompress(dst, src []byte, algo CompressAlgorithm, max int) ([]byte, error) {
+	p.in.Reset(src)
+	var r io.Reader
+	if algo == CompressGzip {
+		if err := p.gzip.Reset(&p.in); err != nil {
+			return dst, err
+		}
+		r = &p.gzip
+	} else {
+		if p.flate == nil {
+			p.flate = flate.NewReader(&p.in)
+		} else if err := p.flate.(flate.Resetter).Reset(&p.in, nil); err != nil {
+			return dst, err
+		}
+		r = p.flate
+	}
+	return readLimited(dst, r, max)
+}
+
+// readLimited appends what r returns up to io.EOF to dst, failing with
+// ErrTooLargePacket past max bytes.
+func readLimited(dst []byte, r io.Reader, max int) ([]byte, error) {
+	start := len(dst)
+	for {
+		if len(dst) == cap(dst) {
+			dst = append(dst, 0)[:len(dst)]
+		}
+		n, err := r.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+		if len(dst)-start > max {
+			return dst, ErrTooLargePacket
+		}
+		if err == io.EOF {
+			return dst, nil
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// zstdCoders returns the shared zstd encoder and decoder, EncodeAll and
+// DecodeAll are safe for concurrent use.
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		// a single segment frame has the content size, which bounds DecodeAll
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithSingleSegment(true))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecodeAllCapLimit(true))
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// compressFrame appends src compressed with algo to dst.
+func compressFrame(dst, src []byte, algo CompressAlgorithm) ([]byte, error) {
+	switch algo {
+	case CompressGzip, CompressDeflate:
+		writers := &gzipWriters
+		if algo == CompressDeflate {
+			writers = &flateWriters
+		}
+		w := writers.Get().(*pooledWriter)
+		defer writers.Put(w)
+		return w.compress(dst, src)
+	case CompressSnappy:
+		start := len(dst)
+		dst = append(dst, make([]byte, snappy.MaxEncodedLen(len(src)))...)
+		return dst[:start+len(snappy.Encode(dst[start:], src))], nil
+	case CompressZstd:
+		encoder, _ := zstdCoders()
+		return encoder.EncodeAll(src, dst), nil
+	}
+	return dst, ErrUnsupportedCompression
+}
+
+// decompressFrame appends src decompressed with algo to dst, the result is
+// limited to max bytes.
+func decompressFrame(dst, src []byte, algo CompressAlgorithm, max int) ([]byte, error) {
+	switch algo {
+	case CompressGzip, CompressDeflate:
+		r := frameReaders.Get().(*pooledReader)
+		defer frameReaders.Put(r)
+		return r.decompress(dst, src, algo, max)
+	case CompressSnappy:
+		n, err := snappy.DecodedLen(src)
+		if err != nil {
+			return dst, err
+		}
+		if n > max {
+			return dst, ErrTooLargePacket
+		}
+		start := len(dst)
+		dst = append(dst, make([]byte, n)...)
+		_, err = snappy.Decode(dst[start:], src)
+		return dst, err
+	case CompressZstd:
+		var header zstd.Header
+		if err := header.Decode(src); err != nil {
+			return dst, err
+		}
+		if !header.HasFCS {
+			return dst, ErrInvalidLength
+		}
+		if header.FrameContentSize > uint64(max) {
+			return dst, ErrTooLargePacket
+		}
+		if n := int(header.FrameContentSize); cap(dst)-len(dst) < n {
+			grown := make([]byte, len(dst), len(dst)+n)
+			copy(grown, dst)
+			dst = grown
+		}
+		_, decoder := zstdCoders()
+		return decoder.DecodeAll(src, dst)
+	}
+	return dst, ErrUnsupportedCompression
+}
@@ -0,0 +1,198 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Compress(t *testing.T) {
+	for algo := CompressNone; algo < compressAlgorithms; algo++ {
+		protocol, err := Compress(JsonTestProtocol(), algo, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		JsonTest(t, protocol)
+		PreEncodedTest(t, protocol)
+	}
+	if _, err := Compress(JsonTestProtocol(), compressAlgorithms, 0); err != ErrUnsupportedCompression {
+		t.Fatalf("unknown algorithm: %v", err)
+	}
+}
+
+func Test_CompressFrames(t *testing.T) {
+	random := make([]byte, 1000)
+	rand.Read(random)
+	chatty := strings.Repeat("chatty ", 200)
+
+	for algo := CompressGzip; algo < compressAlgorithms; algo++ {
+		protocol, _ := Compress(rawProtocol{}, algo, 100)
+		var stream bytes.Buffer
+		codec, _ := protocol.NewCodec(&stream)
+
+		for _, msg := range []string{"small", chatty, string(random), chatty} {
+			if err := codec.Send(msg); err != nil {
+				t.Fatal(err)
+			}
+			frame := stream.Bytes()
+			// the stream compresses every frame over the threshold
+			compressed := frameAlgorithm(frame) != CompressNone
+			expected := msg == chatty || (algo == CompressStream && msg != "small")
+			if compressed != expected || (msg == chatty && len(frame) >= len(msg)) {
+				t.Fatalf("algorithm %d frame of %d bytes is %d bytes, flag %d", algo, len(msg), len(frame), frameAlgorithm(frame))
+			}
+			got, err := codec.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != msg {
+				t.Fatalf("algorithm %d message not match", algo)
+			}
+		}
+	}
+}
+
+func Test_CompressStream(t *testing.T) {
+	msg := `{"user":"someone","action":"move","x":10,"y":20,"seq":1}`
+	sizes := make(map[bool][]int)
+	for _, dict := range []bool{false, true} {
+		protocol, _ := Compress(rawProtocol{}, CompressStream, 0)
+		if dict {
+			protocol.SetDictionary([]byte(msg))
+		}
+		var stream bytes.Buffer
+		codec, _ := protocol.NewCodec(&stream)
+		for i := 0; i < 3; i++ {
+			if err := codec.Send(msg); err != nil {
+				t.Fatal(err)
+			}
+			sizes[dict] = append(sizes[dict], stream.Len())
+			got, err := codec.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != msg {
+				t.Fatalf("message not match: %q", got)
+			}
+		}
+	}
+	if sizes[false][1] >= sizes[false][0] || sizes[true][0] >= sizes[false][0] {
+		t.Fatalf("window not kept: %v", sizes)
+	}
+}
+
+func Test_CompressNegotiate(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	defer conn2.Close()
+
+	protocol1, _ := Compress(rawProtocol{}, CompressGzip, 0)
+	protocol1.SetNegotiate(CompressStream, CompressZstd, CompressGzip)
+	protocol1.SetDictionary([]byte("dict"))
+	protocol2, _ := Compress(rawProtocol{}, CompressGzip, 0)
+	protocol2.SetNegotiate(CompressStream, CompressSnappy, CompressZstd)
+
+	done := make(chan *compressCodec)
+	go func() {
+		codec, err := protocol2.NewCodec(conn2)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- codec.(*compressCodec)
+	}()
+	codec1, err := protocol1.NewCodec(conn1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec2 := <-done
+
+	// the dictionaries differ, so the stream is left out
+	if codec1.(*compressCodec).algo != CompressZstd || codec2.algo != CompressZstd {
+		t.Fatalf("algorithm not agreed: %d, %d", codec1.(*compressCodec).algo, codec2.algo)
+	}
+	if codec2.accept[CompressGzip] || codec2.accept[CompressStream] {
+		t.Fatal("algorithm not negotiated accepted")
+	}
+}
+
+func Test_CompressNegotiateTimeout(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	defer conn2.Close()
+
+	// the peer never answers
+	protocol, _ := Compress(rawProtocol{}, CompressGzip, 0)
+	protocol.SetNegotiate(CompressGzip)
+	protocol.SetHandshakeTimeout(50 * time.Millisecond)
+	_, err := protocol.NewCodec(conn1)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("silent peer not timed out: %v", err)
+	}
+}
+
+func Test_CompressNegotiateBufio(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	defer conn2.Close()
+
+	// the hello is flushed out of the bufio writer
+	compress, _ := Compress(rawProtocol{}, CompressGzip, 0)
+	compress.SetNegotiate(CompressGzip)
+	compress.SetHandshakeTimeout(time.Second)
+	protocol := Bufio(compress, 1024, 1024)
+
+	done := make(chan error)
+	go func() {
+		_, err := protocol.NewCodec(conn2)
+		done <- err
+	}()
+	if _, err := protocol.NewCodec(conn1); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_HandshakeTimeout(t *testing.T) {
+	// a stream without a deadline is closed when the peer never answers
+	r, w := io.Pipe()
+	conn := &testConn{r, io.Discard}
+	defer w.Close()
+	err := exchange(conn, []byte("hello"), 50*time.Millisecond, func(r io.Reader) error {
+		_, err := r.Read(make([]byte, 1))
+		return err
+	})
+	if err != ErrHandshakeTimeout {
+		t.Fatalf("silent peer not timed out: %v", err)
+	}
+
+	var stream bytes.Buffer
+	if err := exchange(&stream, []byte("hello"), 0, nil); err != ErrHandshakeStream {
+		t.Fatalf("stream without deadline or close not rejected: %v", err)
+	}
+}
+
+func Test_CompressLimit(t *testing.T) {
+	protocol, _ := Compress(rawProtocol{}, CompressGzip, 0)
+	var stream bytes.Buffer
+	codec1, _ := protocol.NewCodec(&stream)
+	codec1.Send(strings.Repeat("x", 100000))
+
+	// the limit applies to codecs created afterwards
+	protocol.SetMaxFrame(1000)
+	codec2, _ := protocol.NewCodec(&stream)
+	if _, err := codec2.Receive(); err != ErrTooLargePacket {
+		t.Fatalf("inflated frame not limited: %v", err)
+	}
+	if err := codec2.Send(strings.Repeat("x", 1001)); err != ErrTooLargePacket {
+		t.Fatalf("large frame not rejected: %v", err)
+	}
+	if err := codec1.Send(strings.Repeat("x", 1001)); err != nil {
+		t.Fatalf("limit changed on a running codec: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sort"
+
+	"github.com/FTwOoO/link"
+)
+
+var (
+	ErrDelimiterInBody  = errors.New("Delimiter In Body")
+	ErrInvalidDelimiter = errors.New("Invalid Delimiter")
+)
+
+type DelimitedProtocol struct {
+	base     link.Protocol
+	delims   [][]byte
+	send     []byte
+	maxFrame int
+	readBuf  int
+	pool     BufferPool
+}
+
+// Delimited frames messages of base by delimiters, a frame ends at the first
+// delimiter found and Send ends frames with delims[0]. Frames are limited to
+// maxFrame bytes without the delimiter, 0 means no limit. A longer frame is
+// discarded up to its delimiter and Receive returns ErrTooLargePacket, the
+// next Receive continues with the next frame.
+func Delimited(base link.Protocol, delims [][]byte, maxFrame int) (*DelimitedProtocol, error) {
+	if len(delims) == 0 || maxFrame < 0 {
+		return nil, ErrInvalidDelimiter
+	}
+	p := &DelimitedProtocol{
+		base:     base,
+		send:     delims[0],
+		maxFrame: maxFrame,
+		readBuf:  4096,
+		pool:     DefaultPool,
+	}
+	for _, delim := range delims {
+		if len(delim) == 0 {
+			return nil, ErrInvalidDelimiter
+		}
+		p.delims = append(p.delims, delim)
+	}
+	// a longer delimiter wins over a shorter one found at the same place, "\r\n" before "\n"
+	sort.SliceStable(p.delims, func(i, j int) bool {
+		return len(p.delims[i]) > len(p.delims[j])
+	})
+	return p, nil
+}
+
+// Lines frames by "\r\n" or "\n" and sends "\n".
+func Lines(base link.Protocol, maxFrame int) *DelimitedProtocol {
+	p, _ := Delimited(base, [][]byte{[]byte("\n"), []byte("\r\n")}, maxFrame)
+	return p
+}
+
+func (p *DelimitedProtocol) SetPool(pool BufferPool) {
+	p.pool = pool
+}
+
+func (p *DelimitedProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	codec := &delimitedCodec{
+		p:   p,
+		rw:  rw,
+		buf: make([]byte, p.readBuf),
+	}
+	codec.stream.pool = p.pool
+
+	codec.base, err = codec.stream.newBase(p.base, rw)
+	if err != nil {
+		return
+	}
+	cc = codec
+	return
+}
+
+// index returns where the first delimiter in b starts and its length.
+func (p *DelimitedProtocol) index(b []byte) (int, int) {
+	at, size := -1, 0
+	for _, delim := range p.delims {
+		i := bytes.Index(b, delim)
+		if i >= 0 && (at < 0 || i < at) {
+			at, size = i, len(delim)
+		}
+	}
+	return at, size
+}
+
+func (p *DelimitedProtocol) maxDelim() int {
+	return len(p.delims[0])
+}
+
+// frame returns the body to write before the send delimiter. A body that
+// already ends with it is kept as is, so line based codecs like Json fit.
+func (p *DelimitedProtocol) frame(body []byte) ([]byte, error) {
+	body = bytes.TrimSuffix(body, p.send)
+	if at, _ := p.index(body); at >= 0 {
+		return nil, ErrDelimiterInBody
+	}
+	if p.maxFrame > 0 && len(body) > p.maxFrame {
+		return nil, ErrTooLargePacket
+	}
+	return body, nil
+}
+
+type delimitedCodec struct {
+	p       *DelimitedProtocol
+	base    link.Codec
+	rw      io.ReadWriter
+	buf     []byte
+	r, w    int
+	scanned int
+	// discarding survives a failed read, a retried Receive still drops the frame
+	discarding bool
+	vec        net.Buffers
+	vecArr     [2][]byte
+	stream     fixlenReadWriter
+}
+
+// fill reads more bytes, making room in buf first.
+func (c *delimitedCodec) fill() error {
+	if c.r > 0 {
+		copy(c.buf, c.buf[c.r:c.w])
+		c.w -= c.r
+		c.scanned -= c.r
+		c.r = 0
+	}
+	if c.w == len(c.buf) {
+		buf := make([]byte, 2*len(c.buf))
+		copy(buf, c.buf[:c.w])
+		c.buf = buf
+	}
+	n, err := c.rw.Read(c.buf[c.w:])
+	c.w += n
+	if n > 0 {
+		return nil
+	}
+	return err
+}
+
+// next returns the next frame without its delimiter, the frame is only valid until the next call.
+func (c *delimitedCodec) next() ([]byte, error) {
+	for {
+		at, size := c.p.index(c.buf[c.scanned:c.w])
+		if at >= 0 {
+			end := c.scanned + at
+			frame := c.buf[c.r:end]
+			c.r = end + size
+			c.scanned = c.r
+			if c.discarding || (c.p.maxFrame > 0 && len(frame) > c.p.maxFrame) {
+				c.discarding = false
+				return nil, ErrTooLargePacket
+			}
+			return frame, nil
+		}
+
+		// a delimiter may be split between this read and the next one
+		if keep := c.p.maxDelim() - 1; c.w-keep > c.scanned {
+			c.scanned = c.w - keep
+		}
+		if c.p.maxFrame > 0 && c.scanned-c.r > c.p.maxFrame {
+			// drop the scanned bytes of the over long frame, keep reading for its delimiter
+			c.discarding = true
+			c.r = c.scanned
+		}
+
+		if err := c.fill(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *delimitedCodec) Receive() (interface{}, error) {
+	frame, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+	// the base codec must not keep references to the frame
+	c.stream.recvBuf.Reset(frame)
+	return c.base.Receive()
+}
+
+func (c *delimitedCodec) ReadBuffered() int {
+	return c.w - c.r
+}
+
+func (c *delimitedCodec) Send(msg interface{}) error {
+	if pe, ok := msg.(*link.PreEncoded); ok {
+		if pe.Protocol != c.p {
+			return link.ErrPreEncodedMismatch
+		}
+		_, err := c.rw.Write(pe.Frame)
+		return err
+	}
+
+	c.stream.sendBuf = c.p.pool.Get(0)
+	defer func() {
+		c.p.pool.Put(c.stream.sendBuf)
+		c.stream.sendBuf = nil
+	}()
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+
+	body, err := c.p.frame(c.stream.sendBuf.B)
+	if err != nil {
+		return dropFrame(c.base, err)
+	}
+	c.vec = append(c.vecArr[:0], body, c.p.send)
+	return writeBuffers(c.rw, c.p.pool, &c.vec)
+}
+
+func (c *delimitedCodec) Protocol() link.Protocol {
+	return c.p
+}
+
+func (c *delimitedCodec) Encode(msg interface{}) ([]byte, error) {
+	encoder, ok := c.base.(link.Encoder)
+	if !ok {
+		return nil, link.ErrNotEncoder
+	}
+	body, err := encoder.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	if body, err = c.p.frame(body); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 0, len(body)+len(c.p.send))
+	return append(append(frame, body...), c.p.send...), nil
+}
+
+func (c *delimitedCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/FTwOoO/link"
+)
+
+// rawProtocol sends strings as they are and receives the whole frame.
+type rawProtocol struct{}
+
+func (rawProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	return rawCodec{rw}, nil
+}
+
+type rawCodec struct {
+	rw io.ReadWriter
+}
+
+func (c rawCodec) Receive() (interface{}, error) {
+	b, err := ioutil.ReadAll(c.rw)
+	return string(b), err
+}
+
+func (c rawCodec) Send(msg interface{}) error {
+	_, err := io.WriteString(c.rw, msg.(string))
+	return err
+}
+
+func (c rawCodec) Close() error { return nil }
+
+func Test_Delimited(t *testing.T) {
+	JsonTest(t, Lines(JsonTestProtocol(), 1024))
+	PreEncodedTest(t, Lines(JsonTestProtocol(), 1024))
+}
+
+func Test_DelimitedFrames(t *testing.T) {
+	protocol, err := Delimited(rawProtocol{}, [][]byte{[]byte("\r\n"), []byte("\n"), []byte("||")}, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+	stream.WriteString("a\r\nbb\ncc||" + string(bytes.Repeat([]byte("x"), 10000)) + "\nlast\r\n")
+
+	for _, expected := range []string{"a", "bb", "cc", "", "last"} {
+		msg, err := codec.Receive()
+		if expected == "" {
+			if err != ErrTooLargePacket {
+				t.Fatalf("over long frame not rejected: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != expected {
+			t.Fatalf("frame not match: %q, %q", msg, expected)
+		}
+	}
+
+	if err := codec.Send("x||y"); err != ErrDelimiterInBody {
+		t.Fatalf("delimiter in body not rejected: %v", err)
+	}
+	if err := codec.Send("ok"); err != nil {
+		t.Fatal(err)
+	}
+	if stream.String() != "ok\r\n" {
+		t.Fatalf("frame not match: %q", stream.String())
+	}
+}
+
+func Test_DelimitedSplitRead(t *testing.T) {
+	protocol, _ := Delimited(rawProtocol{}, [][]byte{[]byte("\r\n")}, 0)
+	var rw struct {
+		io.Reader
+		io.Writer
+	}
+	rw.Reader = iotest.OneByteReader(strings.NewReader("ab\r\n\r\ncd\r\n"))
+	codec, _ := protocol.NewCodec(&rw)
+
+	for _, expected := range []string{"ab", "", "cd"} {
+		msg, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != expected {
+			t.Fatalf("frame not match: %q, %q", msg, expected)
+		}
+	}
+}
+
+// scriptReader returns its reads in order, a read is a string or an error.
+type scriptReader []interface{}
+
+func (r *scriptReader) Read(p []byte) (int, error) {
+	if len(*r) == 0 {
+		return 0, io.EOF
+	}
+	read := (*r)[0]
+	*r = (*r)[1:]
+	if err, ok := read.(error); ok {
+		return 0, err
+	}
+	return copy(p, read.(string)), nil
+}
+
+func Test_DelimitedRetry(t *testing.T) {
+	protocol, _ := Delimited(rawProtocol{}, [][]byte{[]byte("\n")}, 8)
+	var rw struct {
+		io.Reader
+		io.Writer
+	}
+	rw.Reader = &scriptReader{strings.Repeat("x", 20), iotest.ErrTimeout, "tail\nnext\n"}
+	codec, _ := protocol.NewCodec(&rw)
+
+	if _, err := codec.Receive(); err != iotest.ErrTimeout {
+		t.Fatalf("read error not returned: %v", err)
+	}
+	if _, err := codec.Receive(); err != ErrTooLargePacket {
+		t.Fatalf("rest of the over long frame not dropped: %v", err)
+	}
+	if msg, err := codec.Receive(); err != nil || msg != "next" {
+		t.Fatalf("frame not match: %q, %v", msg, err)
+	}
+}
@@ -6,79 +6,116 @@ import (
 	"errors"
 	"io"
 	"math"
+	"net"
+	"time"
 
 	"github.com/FTwOoO/link"
 )
 
-var ErrTooLargePacket = errors.New("Too Large Packet")
+var (
+	ErrTooLargePacket  = errors.New("Too Large Packet")
+	ErrUnsupportedHead = errors.New("Unsupported Head Size")
+)
 
 type FixLenProtocol struct {
 	base        link.Protocol
 	n           int
+	varint      bool
 	maxRecv     int
 	maxSend     int
 	headDecoder func([]byte) int
-	headEncoder func([]byte, int)
+	headEncoder func([]byte, int) int
+	pool        BufferPool
+}
+
+// FixLen frames messages of base with an unsigned n byte length head, n is
+// 1, 2, 3, 4 or 8. maxRecv and maxSend are capped to what the head can hold.
+// byteOrder may be nil for a 1 byte head only.
+func FixLen(base link.Protocol, n int, byteOrder binary.ByteOrder, maxRecv, maxSend int) (*FixLenProtocol, error) {
+	return newFixLen(base, n, byteOrder, false, maxRecv, maxSend)
 }
 
-func FixLen(base link.Protocol, n int, byteOrder binary.ByteOrder, maxRecv, maxSend int) *FixLenProtocol {
+// FixLenSigned is FixLen with a signed head for peers that use signed integers,
+// a negative length fails Receive with ErrInvalidLength.
+func FixLenSigned(base link.Protocol, n int, byteOrder binary.ByteOrder, maxRecv, maxSend int) (*FixLenProtocol, error) {
+	return newFixLen(base, n, byteOrder, true, maxRecv, maxSend)
+}
+
+// FixLenVarint frames messages of base with a varint length head, the unsigned
+// base 128 encoding of protobuf and binary.PutUvarint.
+func FixLenVarint(base link.Protocol, maxRecv, maxSend int) (*FixLenProtocol, error) {
 	proto := &FixLenProtocol{
-		n:    n,
-		base: base,
+		base:    base,
+		varint:  true,
+		maxRecv: maxRecv,
+		maxSend: maxSend,
+		pool:    DefaultPool,
 	}
-	switch n {
-	case 1:
-		if maxRecv > math.MaxUint8 {
-			maxRecv = math.MaxUint8
-		}
-		if maxSend > math.MaxUint8 {
-			maxSend = math.MaxUint8
-		}
-		proto.headDecoder = func(b []byte) int {
-			return int(b[0])
-		}
-		proto.headEncoder = func(b []byte, size int) {
-			b[0] = byte(size)
-		}
-	case 2:
-		if maxRecv > math.MaxUint16 {
-			maxRecv = math.MaxUint16
-		}
-		if maxSend > math.MaxUint16 {
-			maxSend = math.MaxUint16
-		}
-		proto.headDecoder = func(b []byte) int {
-			return int(byteOrder.Uint16(b))
-		}
-		proto.headEncoder = func(b []byte, size int) {
-			byteOrder.PutUint16(b, uint16(size))
-		}
-	case 4:
-		if maxRecv > math.MaxUint32 {
-			maxRecv = math.MaxUint32
-		}
-		if maxSend > math.MaxUint32 {
-			maxSend = math.MaxUint32
-		}
-		proto.headDecoder = func(b []byte) int {
-			return int(byteOrder.Uint32(b))
+	proto.headEncoder = func(b []byte, size int) int {
+		return binary.PutUvarint(b, uint64(size))
+	}
+	return proto, nil
+}
+
+func newFixLen(base link.Protocol, n int, byteOrder binary.ByteOrder, signed bool, maxRecv, maxSend int) (*FixLenProtocol, error) {
+	if n != 1 && n != 2 && n != 3 && n != 4 && n != 8 {
+		return nil, ErrUnsupportedHead
+	}
+
+	bits := uint(8 * n)
+	if signed {
+		bits--
+	}
+	max := uint64(math.MaxInt)
+	if bits < 64 && 1<<bits-1 < max {
+		max = 1<<bits - 1
+	}
+	if uint64(maxRecv) > max {
+		maxRecv = int(max)
+	}
+	if uint64(maxSend) > max {
+		maxSend = int(max)
+	}
+
+	// a 1 byte head has no byte order, so a nil one is fine
+	var little bool
+	if n != 1 {
+		if byteOrder == nil {
+			return nil, ErrUnsupportedHead
 		}
-		proto.headEncoder = func(b []byte, size int) {
-			byteOrder.PutUint32(b, uint32(size))
+		var ok bool
+		little, ok = littleEndian(byteOrder)
+		if !ok && !byteOrderSize(n) {
+			return nil, ErrUnsupportedHead
 		}
-	case 8:
-		proto.headDecoder = func(b []byte) int {
-			return int(byteOrder.Uint64(b))
+	}
+	proto := &FixLenProtocol{
+		n:       n,
+		base:    base,
+		maxRecv: maxRecv,
+		maxSend: maxSend,
+		pool:    DefaultPool,
+	}
+	proto.headDecoder = func(b []byte) int {
+		v := getUint(b[:n], byteOrder, little)
+		if signed {
+			shift := 64 - uint(8*n)
+			return int(int64(v<<shift) >> shift)
 		}
-		proto.headEncoder = func(b []byte, size int) {
-			byteOrder.PutUint64(b, uint64(size))
+		if v > uint64(math.MaxInt) {
+			return math.MaxInt
 		}
-	default:
-		panic("FixLenProtocol: unsupported head size")
+		return int(v)
 	}
-	proto.maxRecv = maxRecv
-	proto.maxSend = maxSend
-	return proto
+	proto.headEncoder = func(b []byte, size int) int {
+		putUint(b[:n], uint64(size), byteOrder, little)
+		return n
+	}
+	return proto, nil
+}
+
+func (p *FixLenProtocol) SetPool(pool BufferPool) {
+	p.pool = pool
 }
 
 func (p *FixLenProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
@@ -86,9 +123,10 @@ func (p *FixLenProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
 		rw:             rw,
 		FixLenProtocol: p,
 	}
-	codec.headBuf = codec.head[:p.n]
+	codec.fixlenReadWriter.pool = p.pool
+	codec.byteReader, _ = rw.(io.ByteReader)
 
-	codec.base, err = p.base.NewCodec(&codec.fixlenReadWriter)
+	codec.base, err = codec.fixlenReadWriter.newBase(p.base, rw)
 	if err != nil {
 		return
 	}
@@ -98,60 +136,283 @@ func (p *FixLenProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
 
 type fixlenReadWriter struct {
 	recvBuf bytes.Reader
-	sendBuf bytes.Buffer
+	sendBuf *Buffer
+	pool    BufferPool
+	// raw is the connection while the base codec is created, a base that
+	// handshakes in NewCodec talks to the peer unframed
+	raw io.ReadWriter
+}
+
+// frameDropper is a base codec that depends on every frame it wrote arriving,
+// like gob, which describes a type only once per connection.
+type frameDropper interface {
+	dropFrame(err error)
+}
+
+// dropFrame tells base that the wrapper didn't send the frame base just wrote.
+func dropFrame(base link.Codec, err error) error {
+	if d, ok := base.(frameDropper); ok {
+		d.dropFrame(err)
+	}
+	return err
+}
+
+// newBase creates the codec of base on rw.
+func (rw *fixlenReadWriter) newBase(base link.Protocol, raw io.ReadWriter) (link.Codec, error) {
+	rw.raw = raw
+	defer func() { rw.raw = nil }()
+	return base.NewCodec(rw)
 }
 
 func (rw *fixlenReadWriter) Read(p []byte) (int, error) {
+	if rw.raw != nil {
+		return rw.raw.Read(p)
+	}
 	return rw.recvBuf.Read(p)
 }
 
+// ReadByte lets decoders like gob read the frame without buffering past it.
+func (rw *fixlenReadWriter) ReadByte() (byte, error) {
+	if rw.raw != nil {
+		var b [1]byte
+		_, err := io.ReadFull(rw.raw, b[:])
+		return b[0], err
+	}
+	return rw.recvBuf.ReadByte()
+}
+
+// Flush, SetDeadline and Close reach the connection while the base codec is
+// created, so its handshake is flushed and limited in time.
+func (rw *fixlenReadWriter) Flush() error {
+	if f, ok := rw.raw.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (rw *fixlenReadWriter) SetDeadline(t time.Time) error {
+	if d, ok := rw.raw.(deadlineSetter); ok {
+		return d.SetDeadline(t)
+	}
+	return errNoDeadline
+}
+
+func (rw *fixlenReadWriter) Close() error {
+	if c, ok := rw.raw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 func (rw *fixlenReadWriter) Write(p []byte) (int, error) {
-	return rw.sendBuf.Write(p)
+	if rw.raw != nil {
+		return rw.raw.Write(p)
+	}
+	if rw.sendBuf == nil {
+		// a base writing on its own outside of a send has no frame to go in
+		return 0, io.ErrClosedPipe
+	}
+	rw.sendBuf = grow(rw.pool, rw.sendBuf, len(p))
+	rw.sendBuf.B = append(rw.sendBuf.B, p...)
+	return len(p), nil
 }
 
 type fixlenCodec struct {
-	base    link.Codec
-	head    [8]byte
-	headBuf []byte
-	bodyBuf []byte
-	rw      io.ReadWriter
+	base       link.Codec
+	byteReader io.ByteReader
+	head       [binary.MaxVarintLen64]byte
+	sendHead   [binary.MaxVarintLen64]byte
+	vec        net.Buffers
+	vecArr     [2][]byte
+	batch      *Buffer
+	rw         io.ReadWriter
 	*FixLenProtocol
 	fixlenReadWriter
 }
 
 func (c *fixlenCodec) Receive() (interface{}, error) {
-	if _, err := io.ReadFull(c.rw, c.headBuf); err != nil {
-		return nil, err
+	var size int
+	if c.varint {
+		_, length, err := readUvarint(c.rw, c.byteReader, c.head[:])
+		if err != nil {
+			return nil, err
+		}
+		size = math.MaxInt
+		if length < uint64(math.MaxInt) {
+			size = int(length)
+		}
+	} else {
+		if _, err := io.ReadFull(c.rw, c.head[:c.n]); err != nil {
+			return nil, err
+		}
+		size = c.headDecoder(c.head[:c.n])
+	}
+	if size < 0 {
+		return nil, ErrInvalidLength
 	}
-	size := c.headDecoder(c.headBuf)
 	if size > c.maxRecv {
 		return nil, ErrTooLargePacket
 	}
-	if cap(c.bodyBuf) < size {
-		c.bodyBuf = make([]byte, size, size+128)
-	}
-	buff := c.bodyBuf[:size]
-	if _, err := io.ReadFull(c.rw, buff); err != nil {
+
+	// the base codec must not keep references to the frame
+	buff := c.FixLenProtocol.pool.Get(size)
+	defer c.FixLenProtocol.pool.Put(buff)
+	if _, err := io.ReadFull(c.rw, buff.B); err != nil {
 		return nil, err
 	}
-	c.recvBuf.Reset(buff)
+	c.recvBuf.Reset(buff.B)
 	msg, err := c.base.Receive()
 	return msg, err
 }
 
 func (c *fixlenCodec) Send(msg interface{}) error {
-	c.sendBuf.Reset()
-	c.sendBuf.Write(c.headBuf)
+	if c.batch != nil {
+		if err := c.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if pe, ok := msg.(*link.PreEncoded); ok {
+		if pe.Protocol != c.FixLenProtocol {
+			return link.ErrPreEncodedMismatch
+		}
+		_, err := c.rw.Write(pe.Frame)
+		return err
+	}
+
+	c.sendBuf = c.FixLenProtocol.pool.Get(0)
+	defer func() {
+		c.FixLenProtocol.pool.Put(c.sendBuf)
+		c.sendBuf = nil
+	}()
 	err := c.base.Send(msg)
 	if err != nil {
 		return err
 	}
-	buff := c.sendBuf.Bytes()
-	c.headEncoder(buff, len(buff)-c.n)
-	_, err = c.rw.Write(buff)
+	if len(c.sendBuf.B) > c.maxSend {
+		return dropFrame(c.base, ErrTooLargePacket)
+	}
+
+	head := c.sendHead[:c.headEncoder(c.sendHead[:], len(c.sendBuf.B))]
+	c.vec = append(c.vecArr[:0], head, c.sendBuf.B)
+	return writeBuffers(c.rw, c.FixLenProtocol.pool, &c.vec)
+}
+
+// writeBuffers writes vec with one writev on a TCP or Unix connection and
+// with one Write otherwise, net.Buffers would write each slice on its own and
+// a wrapping writer may take every Write as a record. A connection wrapper
+// keeps the writev with a WriteBuffers method.
+func writeBuffers(w io.Writer, pool BufferPool, vec *net.Buffers) error {
+	switch conn := w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		_, err := vec.WriteTo(w)
+		return err
+	case interface {
+		WriteBuffers(*net.Buffers) (int64, error)
+	}:
+		_, err := conn.WriteBuffers(vec)
+		return err
+	}
+	size := 0
+	for _, b := range *vec {
+		size += len(b)
+	}
+	buf := pool.Get(size)
+	defer pool.Put(buf)
+	n := 0
+	for _, b := range *vec {
+		n += copy(buf.B[n:], b)
+	}
+	_, err := w.Write(buf.B)
 	return err
 }
 
+// Enqueue encodes the frame in place after the frames already queued.
+func (c *fixlenCodec) Enqueue(msg interface{}) error {
+	if c.batch == nil {
+		c.batch = c.FixLenProtocol.pool.Get(0)
+	}
+
+	if pe, ok := msg.(*link.PreEncoded); ok {
+		if pe.Protocol != c.FixLenProtocol {
+			return link.ErrPreEncodedMismatch
+		}
+		c.sendBuf = c.batch
+		c.Write(pe.Frame)
+		c.batch = c.sendBuf
+		c.sendBuf = nil
+		return nil
+	}
+
+	// a fixed size head is written in place, a varint head once the size is known
+	start := len(c.batch.B)
+	c.sendBuf = c.batch
+	c.Write(c.sendHead[:c.n])
+	err := c.base.Send(msg)
+	c.batch = c.sendBuf
+	c.sendBuf = nil
+	size := len(c.batch.B) - start - c.n
+	if err == nil && size > c.maxSend {
+		err = dropFrame(c.base, ErrTooLargePacket)
+	}
+	if err != nil {
+		c.batch.B = c.batch.B[:start]
+		return err
+	}
+
+	if !c.varint {
+		c.headEncoder(c.batch.B[start:], size)
+		return nil
+	}
+	n := c.headEncoder(c.sendHead[:], size)
+	c.batch = grow(c.FixLenProtocol.pool, c.batch, n)
+	c.batch.B = c.batch.B[:len(c.batch.B)+n]
+	copy(c.batch.B[start+n:], c.batch.B[start:])
+	copy(c.batch.B[start:], c.sendHead[:n])
+	return nil
+}
+
+func (c *fixlenCodec) Buffered() int {
+	if c.batch == nil {
+		return 0
+	}
+	return len(c.batch.B)
+}
+
+func (c *fixlenCodec) Flush() error {
+	if c.batch == nil {
+		return nil
+	}
+	_, err := c.rw.Write(c.batch.B)
+	c.FixLenProtocol.pool.Put(c.batch)
+	c.batch = nil
+	return err
+}
+
+func (c *fixlenCodec) Protocol() link.Protocol {
+	return c.FixLenProtocol
+}
+
+func (c *fixlenCodec) Encode(msg interface{}) ([]byte, error) {
+	encoder, ok := c.base.(link.Encoder)
+	if !ok {
+		return nil, link.ErrNotEncoder
+	}
+	body, err := encoder.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > c.maxSend {
+		return nil, ErrTooLargePacket
+	}
+	var head [binary.MaxVarintLen64]byte
+	n := c.headEncoder(head[:], len(body))
+	frame := make([]byte, n+len(body))
+	copy(frame, head[:n])
+	copy(frame[n:], body)
+	return frame, nil
+}
+
 func (c *fixlenCodec) Close() error {
 	if closer, ok := c.rw.(io.Closer); ok {
 		return closer.Close()
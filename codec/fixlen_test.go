@@ -1,12 +1,261 @@
 package codec
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
 	"testing"
+
+	"github.com/FTwOoO/link"
 )
 
+func FixLenTestProtocol(tb testing.TB, max int) *FixLenProtocol {
+	protocol, err := FixLen(JsonTestProtocol(), 2, binary.LittleEndian, max, max)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return protocol
+}
+
 func Test_FixLen(t *testing.T) {
-	base := JsonTestProtocol()
-	protocol := FixLen(base, 2, binary.LittleEndian, 1024, 1024)
+	JsonTest(t, FixLenTestProtocol(t, 1024))
+}
+
+func Test_FixLenPreEncoded(t *testing.T) {
+	PreEncodedTest(t, FixLenTestProtocol(t, 1024))
+}
+
+// writeCounter counts the Write calls.
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func Test_FixLenOneWrite(t *testing.T) {
+	var stream writeCounter
+	codec, _ := FixLenTestProtocol(t, 1024).NewCodec(&stream)
+	codec.Send(&MyMessage1{"abc", 123})
+	if stream.writes != 1 {
+		t.Fatalf("frame written in %d writes", stream.writes)
+	}
+	if _, err := codec.Receive(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// buffersWriter is a connection wrapper that keeps writev.
+type buffersWriter struct {
+	writeCounter
+	vectors int
+}
+
+func (w *buffersWriter) WriteBuffers(vec *net.Buffers) (int64, error) {
+	w.vectors++
+	return vec.WriteTo(&w.writeCounter)
+}
+
+func Test_FixLenWriteBuffers(t *testing.T) {
+	var stream buffersWriter
+	codec, _ := FixLenTestProtocol(t, 1024).NewCodec(&stream)
+	codec.Send(&MyMessage1{"abc", 123})
+	if stream.vectors != 1 {
+		t.Fatalf("vector not passed to the wrapper: %d", stream.vectors)
+	}
+	if _, err := codec.Receive(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type benchReadWriter struct {
+	bytes.Reader
+}
+
+func (rw *benchReadWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func Benchmark_FixLenSend(b *testing.B) {
+	codec, _ := FixLenTestProtocol(b, 1024).NewCodec(new(benchReadWriter))
+	msg := &MyMessage1{"abc", 123}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		codec.Send(msg)
+	}
+}
+
+func Benchmark_FixLenReceive(b *testing.B) {
+	protocol := FixLenTestProtocol(b, 1024)
+	var stream bytes.Buffer
+	encoder, _ := protocol.NewCodec(&stream)
+	encoder.Send(&MyMessage1{"abc", 123})
+	frame := stream.Bytes()
+
+	rw := new(benchReadWriter)
+	codec, _ := protocol.NewCodec(rw)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rw.Reset(frame)
+		codec.Receive()
+	}
+}
+
+func BatchTest(t *testing.T, protocol link.Protocol) {
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+	batch := codec.(link.BatchCodec)
+
+	pe, err := link.PreEncode(codec, &MyMessage1{"pre", 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := batch.Enqueue(&MyMessage1{"abc", i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batch.Enqueue(pe); err != nil {
+		t.Fatal(err)
+	}
+	if stream.Len() != 0 || batch.Buffered() == 0 {
+		t.Fatalf("enqueued messages written before flush: %d, %d", stream.Len(), batch.Buffered())
+	}
+	if err := batch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		recvMsg, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := recvMsg.(*MyMessage1)
+		if i < 3 && *msg != (MyMessage1{"abc", i}) || i == 3 && msg.Field1 != "pre" {
+			t.Fatalf("message not match: %d, %v", i, msg)
+		}
+	}
+}
+
+func Test_FixLenBatch(t *testing.T) {
+	BatchTest(t, FixLenTestProtocol(t, 1024))
+}
+
+func Test_FixLenHeads(t *testing.T) {
+	if _, err := FixLen(JsonTestProtocol(), 5, binary.BigEndian, 1024, 1024); err != ErrUnsupportedHead {
+		t.Fatalf("unsupported head not rejected: %v", err)
+	}
+	if _, err := FixLen(JsonTestProtocol(), 2, nil, 1024, 1024); err != ErrUnsupportedHead {
+		t.Fatalf("nil byte order not rejected: %v", err)
+	}
+	protocol, err := FixLen(JsonTestProtocol(), 1, nil, 200, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
 	JsonTest(t, protocol)
+
+	for _, n := range []int{1, 2, 3, 4, 8} {
+		for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian, wrappedOrder{binary.LittleEndian}} {
+			protocol, err := FixLen(JsonTestProtocol(), n, order, 200, 200)
+			if err != nil {
+				t.Fatal(err)
+			}
+			JsonTest(t, protocol)
+			BatchTest(t, protocol)
+
+			signed, _ := FixLenSigned(JsonTestProtocol(), n, order, 200, 200)
+			JsonTest(t, signed)
+		}
+	}
+
+	// the caller's ByteOrder is used even when it isn't binary.LittleEndian itself
+	protocol, _ = FixLen(JsonTestProtocol(), 2, wrappedOrder{binary.LittleEndian}, 1024, 1024)
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+	codec.Send(&MyMessage1{"abc", 123})
+	if int(binary.LittleEndian.Uint16(stream.Bytes())) != stream.Len()-2 {
+		t.Fatalf("head not little endian: % x", stream.Bytes()[:2])
+	}
+
+	varint, _ := FixLenVarint(JsonTestProtocol(), 1024, 1024)
+	JsonTest(t, varint)
+	PreEncodedTest(t, varint)
+	BatchTest(t, varint)
+}
+
+func Test_FixLenMaxSend(t *testing.T) {
+	protocol, _ := FixLen(JsonTestProtocol(), 1, binary.BigEndian, 1024, 1024)
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+	msg := &MyMessage1{string(bytes.Repeat([]byte("x"), 300)), 1}
+
+	if err := codec.Send(msg); err != ErrTooLargePacket {
+		t.Fatalf("large message sent: %v", err)
+	}
+	if err := codec.(link.BatchCodec).Enqueue(msg); err != ErrTooLargePacket {
+		t.Fatalf("large message enqueued: %v", err)
+	}
+	if _, err := link.PreEncode(codec, msg); err != ErrTooLargePacket {
+		t.Fatalf("large message encoded: %v", err)
+	}
+	if stream.Len() != 0 || codec.(link.BatchCodec).Buffered() != 0 {
+		t.Fatalf("large message written: %d", stream.Len())
+	}
+
+	signed, _ := FixLenSigned(JsonTestProtocol(), 2, binary.BigEndian, 1024, 1024)
+	codec, _ = signed.NewCodec(&stream)
+	stream.Write([]byte{0xff, 0xfe})
+	if _, err := codec.Receive(); err != ErrInvalidLength {
+		t.Fatalf("negative length received: %v", err)
+	}
+}
+
+// helloProtocol exchanges a hello in NewCodec like the negotiating codecs.
+type helloProtocol struct {
+	base link.Protocol
+}
+
+func (p helloProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	var peer [5]byte
+	err := exchange(rw, []byte("hello"), 0, func(r io.Reader) error {
+		_, err := io.ReadFull(r, peer[:])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if string(peer[:]) != "hello" {
+		return nil, fmt.Errorf("hello not match: %q", peer)
+	}
+	return p.base.NewCodec(rw)
+}
+
+func Test_FramedHandshake(t *testing.T) {
+	base := helloProtocol{JsonTestProtocol()}
+	fixlen, _ := FixLen(base, 2, binary.BigEndian, 1024, 1024)
+	lengthField, _ := LengthField(base, LengthFieldConfig{Size: 4, Strip: StripHeader})
+	compress, _ := Compress(base, CompressGzip, 0)
+
+	for _, protocol := range []link.Protocol{fixlen, Lines(base, 1024), lengthField, compress} {
+		var stream bytes.Buffer
+		codec1, codec2, err := handshakePair(t, protocol, protocol, &stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := codec1.Send(&MyMessage1{"abc", 123}); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := codec2.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *msg.(*MyMessage1) != (MyMessage1{"abc", 123}) {
+			t.Fatalf("message not match: %v", msg)
+		}
+	}
 }
@@ -0,0 +1,165 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/FTwOoO/link"
+)
+
+var ErrGobRegister = errors.New("Gob Register Failed")
+
+// GobProtocol sends messages as gob encoded interface values, so the peer
+// gets the type it was sent. Each codec keeps its gob.Encoder and
+// gob.Decoder, a type is described once per connection. So a codec fails for
+// good when a framing codec drops one of its frames, a too large one for example.
+type GobProtocol struct {
+	types map[reflect.Type]bool
+}
+
+func Gob() *GobProtocol {
+	return &GobProtocol{
+		types: make(map[reflect.Type]bool),
+	}
+}
+
+// Register registers the pointer type of t with gob.Register, Receive returns
+// pointers like Json and Send takes values as well. gob's registry is shared
+// by the whole process, a type already registered under another name, by any
+// GobProtocol or package, fails with ErrGobRegister.
+func (g *GobProtocol) Register(t interface{}) error {
+	value := g.value(t)
+	return g.register(value, func() { gob.Register(value) })
+}
+
+// RegisterName is Register with the name of gob.RegisterName.
+func (g *GobProtocol) RegisterName(name string, t interface{}) error {
+	value := g.value(t)
+	return g.register(value, func() { gob.RegisterName(name, value) })
+}
+
+// value returns a new pointer of the type of t.
+func (g *GobProtocol) value(t interface{}) interface{} {
+	rt := reflect.TypeOf(t)
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	return reflect.New(rt).Interface()
+}
+
+// register turns the panic of gob on a name conflict into an error.
+func (g *GobProtocol) register(value interface{}, register func()) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("%w: %v", ErrGobRegister, v)
+		}
+	}()
+	register()
+	g.types[reflect.TypeOf(value).Elem()] = true
+	return nil
+}
+
+// MessageTypes returns the registered types as Receive returns them, as pointers.
+func (g *GobProtocol) MessageTypes() []reflect.Type {
+	types := make([]reflect.Type, 0, len(g.types))
+	for t := range g.types {
+		types = append(types, reflect.PtrTo(t))
+	}
+	return types
+}
+
+func (g *GobProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	codec := &gobCodec{
+		p: g,
+		w: rw,
+	}
+	// gob reads exactly one message from an io.ByteReader, so a framing codec
+	// can hand it one frame at a time
+	var r io.Reader = rw
+	if _, ok := rw.(io.ByteReader); !ok {
+		codec.reader = bufio.NewReader(rw)
+		r = codec.reader
+	}
+	codec.decoder = gob.NewDecoder(r)
+	codec.encoder = gob.NewEncoder(&codec.buf)
+	codec.closer, _ = rw.(io.Closer)
+	return codec, nil
+}
+
+type gobCodec struct {
+	p       *GobProtocol
+	w       io.Writer
+	closer  io.Closer
+	reader  *bufio.Reader
+	decoder *gob.Decoder
+	encoder *gob.Encoder
+	buf     bytes.Buffer
+	err     error
+}
+
+func (c *gobCodec) Receive() (interface{}, error) {
+	var msg interface{}
+	if err := c.decoder.Decode(&msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c *gobCodec) Send(msg interface{}) error {
+	if _, ok := msg.(*link.PreEncoded); ok {
+		// the frames depend on the types sent before on the connection
+		return link.ErrPreEncodedMismatch
+	}
+	if c.err != nil {
+		return c.err
+	}
+
+	v := reflect.ValueOf(msg)
+	if !v.IsValid() {
+		return link.ErrNotRegistered
+	}
+	if v.Kind() != reflect.Ptr {
+		if !c.p.types[v.Type()] {
+			return link.ErrNotRegistered
+		}
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		msg = ptr.Interface()
+	} else if !c.p.types[v.Type().Elem()] {
+		return link.ErrNotRegistered
+	}
+
+	c.buf.Reset()
+	if err := c.encoder.Encode(&msg); err != nil {
+		// the encoder may count types as sent that never went out
+		c.err = err
+		return err
+	}
+	_, err := c.w.Write(c.buf.Bytes())
+	return err
+}
+
+// dropFrame fails the codec for good, the encoder counts the types in the
+// dropped frame as sent and the peer couldn't decode them later.
+func (c *gobCodec) dropFrame(err error) {
+	c.err = err
+}
+
+func (c *gobCodec) ReadBuffered() int {
+	if c.reader != nil {
+		return c.reader.Buffered()
+	}
+	return 0
+}
+
+func (c *gobCodec) Close() error {
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/FTwOoO/link"
+)
+
+type gobEnvelope struct {
+	Payload interface{}
+}
+
+type gobUnregistered struct {
+	Field1 string
+}
+
+func GobTestProtocol() *GobProtocol {
+	protocol := Gob()
+	protocol.Register(MyMessage1{})
+	protocol.RegisterName("msg2", &MyMessage2{})
+	protocol.Register(gobEnvelope{})
+	return protocol
+}
+
+func GobTest(t *testing.T, protocol link.Protocol) {
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+
+	var sizes []int
+	for i := 0; i < 2; i++ {
+		sendMsg1 := MyMessage1{"abc", 123 + i}
+		if err := codec.Send(&sendMsg1); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, stream.Len())
+		recvMsg1, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *recvMsg1.(*MyMessage1) != sendMsg1 {
+			t.Fatalf("message not match: %v, %v", sendMsg1, recvMsg1)
+		}
+	}
+	if sizes[1] >= sizes[0] {
+		t.Fatalf("type sent again: %v", sizes)
+	}
+
+	// a value comes back as a pointer
+	sendMsg2 := MyMessage2{123, "abc"}
+	if err := codec.Send(sendMsg2); err != nil {
+		t.Fatal(err)
+	}
+	recvMsg2, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *recvMsg2.(*MyMessage2) != sendMsg2 {
+		t.Fatalf("message not match: %v, %v", sendMsg2, recvMsg2)
+	}
+
+	if err := codec.Send(&gobEnvelope{&MyMessage1{"def", 456}}); err != nil {
+		t.Fatal(err)
+	}
+	recvMsg3, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload, ok := recvMsg3.(*gobEnvelope).Payload.(*MyMessage1); !ok || payload.Field1 != "def" {
+		t.Fatalf("interface field not match: %#v", recvMsg3)
+	}
+}
+
+func Test_Gob(t *testing.T) {
+	GobTest(t, GobTestProtocol())
+}
+
+func Test_GobFixLen(t *testing.T) {
+	protocol, err := FixLen(GobTestProtocol(), 2, binary.LittleEndian, 1024, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	GobTest(t, protocol)
+}
+
+func Test_GobFrameDropped(t *testing.T) {
+	protocol, _ := FixLen(GobTestProtocol(), 2, binary.LittleEndian, 1024, 40)
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+
+	// the dropped frame described the type, later frames would refer to it
+	if err := codec.Send(&MyMessage1{"abc", 123}); err != ErrTooLargePacket {
+		t.Fatalf("large frame not rejected: %v", err)
+	}
+	if err := codec.Send(&MyMessage1{"abc", 123}); err != ErrTooLargePacket {
+		t.Fatalf("codec not failed after a dropped frame: %v", err)
+	}
+	if stream.Len() != 0 {
+		t.Fatal("undecodable frame written")
+	}
+}
+
+func Test_GobNotRegistered(t *testing.T) {
+	var stream bytes.Buffer
+	codec, _ := GobTestProtocol().NewCodec(&stream)
+	if err := codec.Send(&gobUnregistered{}); err != link.ErrNotRegistered {
+		t.Fatalf("unregistered type not rejected: %v", err)
+	}
+	if stream.Len() != 0 {
+		t.Fatal("unregistered type written")
+	}
+	codec.Send(&MyMessage1{"abc", 123})
+	if msg, err := codec.Receive(); err != nil || msg.(*MyMessage1).Field1 != "abc" {
+		t.Fatalf("codec broken after rejection: %v, %v", msg, err)
+	}
+}
+
+type gobConflict struct{}
+
+func Test_GobRegisterConflict(t *testing.T) {
+	protocol := Gob()
+	if err := protocol.RegisterName("gobConflict", gobConflict{}); err != nil {
+		t.Fatal(err)
+	}
+	// gob's registry is process wide, another protocol sees the name too
+	other := Gob()
+	if err := other.RegisterName("gobConflict2", &gobConflict{}); !errors.Is(err, ErrGobRegister) {
+		t.Fatalf("name conflict not returned: %v", err)
+	}
+	if len(other.MessageTypes()) != 0 {
+		t.Fatal("conflicting type registered")
+	}
+}
@@ -0,0 +1,87 @@
+package codec
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// DefaultHandshakeTimeout limits a handshake when the protocol sets no
+// timeout, so a peer that never answers doesn't hold the connection.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+var (
+	ErrHandshakeTimeout = errors.New("Handshake Timeout")
+	ErrHandshakeStream  = errors.New("Handshake Stream Has No Deadline Or Close")
+)
+
+// errNoDeadline is returned by a wrapping stream whose connection has no deadline.
+var errNoDeadline = errors.New("No Deadline")
+
+type deadlineSetter interface {
+	SetDeadline(t time.Time) error
+}
+
+type flusher interface {
+	Flush() error
+}
+
+// exchange writes hello and lets read take the peer's hello from rw. Both
+// sides write at once, so the write must not wait for the read on an
+// unbuffered connection, and a buffered one is flushed. The exchange is
+// limited to timeout with a deadline on rw, or by closing rw when it has no
+// deadline, a stream with neither fails with ErrHandshakeStream. The deadline
+// is left in place when the exchange fails since the connection is done for.
+func exchange(rw io.ReadWriter, hello []byte, timeout time.Duration, read func(r io.Reader) error) error {
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	conn, hasDeadline := rw.(deadlineSetter)
+	if hasDeadline && conn.SetDeadline(time.Now().Add(timeout)) != nil {
+		hasDeadline = false
+	}
+	closer, _ := rw.(io.Closer)
+	var timer *time.Timer
+	fired := make(chan struct{})
+	if !hasDeadline {
+		if closer == nil {
+			return ErrHandshakeStream
+		}
+		timer = time.AfterFunc(timeout, func() {
+			closer.Close()
+			close(fired)
+		})
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := rw.Write(hello)
+		if f, ok := rw.(flusher); ok && err == nil {
+			err = f.Flush()
+		}
+		written <- err
+	}()
+	err := read(rw)
+	if err != nil {
+		// unblock the write, it is waited for so it doesn't outlive the exchange
+		if hasDeadline {
+			conn.SetDeadline(time.Now())
+		} else {
+			closer.Close()
+		}
+	}
+	if werr := <-written; err == nil {
+		err = werr
+	}
+	if timer != nil && !timer.Stop() {
+		<-fired
+		return ErrHandshakeTimeout
+	}
+	if err != nil {
+		return err
+	}
+	if hasDeadline {
+		return conn.SetDeadline(time.Time{})
+	}
+	return nil
+}
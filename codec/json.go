@@ -1,6 +1,7 @@
 package codec
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
 	"reflect"
@@ -39,9 +40,19 @@ func (j *JsonProtocol) RegisterName(name string, t interface{}) {
 	j.names[rt] = name
 }
 
+// MessageTypes returns the registered types as Receive returns them, as pointers.
+func (j *JsonProtocol) MessageTypes() []reflect.Type {
+	types := make([]reflect.Type, 0, len(j.names))
+	for t := range j.names {
+		types = append(types, reflect.PtrTo(t))
+	}
+	return types
+}
+
 func (j *JsonProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
 	codec := &jsonCodec{
 		p:       j,
+		w:       rw,
 		encoder: json.NewEncoder(rw),
 		decoder: json.NewDecoder(rw),
 	}
@@ -51,7 +62,7 @@ func (j *JsonProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
 
 type jsonIn struct {
 	Head string
-	Body *json.RawMessage
+	Body json.RawMessage
 }
 
 type jsonOut struct {
@@ -61,14 +72,19 @@ type jsonOut struct {
 
 type jsonCodec struct {
 	p       *JsonProtocol
+	w       io.Writer
 	closer  io.Closer
 	encoder *json.Encoder
 	decoder *json.Decoder
+	in      jsonIn
 }
 
 func (c *jsonCodec) Receive() (interface{}, error) {
-	var in jsonIn
-	err := c.decoder.Decode(&in)
+	// reuse the body buffer across messages
+	in := &c.in
+	in.Head = ""
+	in.Body = in.Body[:0]
+	err := c.decoder.Decode(in)
 	if err != nil {
 		return nil, err
 	}
@@ -78,14 +94,14 @@ func (c *jsonCodec) Receive() (interface{}, error) {
 			body = reflect.New(t).Interface()
 		}
 	}
-	err = json.Unmarshal(*in.Body, &body)
+	err = json.Unmarshal(in.Body, &body)
 	if err != nil {
 		return nil, err
 	}
 	return body, nil
 }
 
-func (c *jsonCodec) Send(msg interface{}) error {
+func (c *jsonCodec) out(msg interface{}) *jsonOut {
 	var out jsonOut
 	t := reflect.TypeOf(msg)
 	if t.Kind() == reflect.Ptr {
@@ -95,7 +111,46 @@ func (c *jsonCodec) Send(msg interface{}) error {
 		out.Head = name
 	}
 	out.Body = msg
-	return c.encoder.Encode(&out)
+	return &out
+}
+
+func (c *jsonCodec) Send(msg interface{}) error {
+	if pe, ok := msg.(*link.PreEncoded); ok {
+		if pe.Protocol != c.p {
+			return link.ErrPreEncodedMismatch
+		}
+		_, err := c.w.Write(pe.Frame)
+		return err
+	}
+	return c.encoder.Encode(c.out(msg))
+}
+
+// ReadBuffered ignores the whitespace between values, it doesn't start a message.
+func (c *jsonCodec) ReadBuffered() int {
+	r, ok := c.decoder.Buffered().(*bytes.Reader)
+	if !ok {
+		return 0
+	}
+	for r.Len() > 0 {
+		b, _ := r.ReadByte()
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return r.Len() + 1
+		}
+	}
+	return 0
+}
+
+func (c *jsonCodec) Protocol() link.Protocol {
+	return c.p
+}
+
+// Encode returns the same bytes as json.Encoder, including the trailing newline.
+func (c *jsonCodec) Encode(msg interface{}) ([]byte, error) {
+	frame, err := json.Marshal(c.out(msg))
+	if err != nil {
+		return nil, err
+	}
+	return append(frame, '\n'), nil
 }
 
 func (c *jsonCodec) Close() error {
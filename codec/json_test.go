@@ -109,3 +109,85 @@ func Test_Json(t *testing.T) {
 	protocol := JsonTestProtocol()
 	JsonTest(t, protocol)
 }
+
+func PreEncodedTest(t *testing.T, protocol link.Protocol) {
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+
+	sendMsg := MyMessage1{
+		Field1: "abc",
+		Field2: 123,
+	}
+	pe, err := link.PreEncode(codec, &sendMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := codec.Send(pe); err != nil {
+			t.Fatal(err)
+		}
+		recvMsg, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := recvMsg.(*MyMessage1); !ok {
+			t.Fatalf("message type not match: %#v", recvMsg)
+		}
+		if sendMsg != *(recvMsg.(*MyMessage1)) {
+			t.Fatalf("message not match: %v, %v", sendMsg, recvMsg)
+		}
+	}
+
+	other := &link.PreEncoded{Protocol: Json(), Frame: pe.Frame}
+	if err := codec.Send(other); err != link.ErrPreEncodedMismatch {
+		t.Fatalf("pre-encoded protocol mismatch not detected: %v", err)
+	}
+}
+
+func Test_JsonPreEncoded(t *testing.T) {
+	PreEncodedTest(t, JsonTestProtocol())
+}
+
+func Benchmark_JsonReceive(b *testing.B) {
+	protocol := JsonTestProtocol()
+	var stream bytes.Buffer
+	encoder, _ := protocol.NewCodec(&stream)
+	for i := 0; i < 1000; i++ {
+		encoder.Send(&MyMessage1{"abc", 123})
+	}
+	frames := stream.Bytes()
+
+	rw := new(benchReadWriter)
+	rw.Reset(frames)
+	codec, _ := protocol.NewCodec(rw)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if i%1000 == 0 {
+			rw.Reset(frames)
+			codec, _ = protocol.NewCodec(rw)
+		}
+		codec.Receive()
+	}
+}
+
+func Test_JsonReadBuffered(t *testing.T) {
+	var stream bytes.Buffer
+	codec, _ := JsonTestProtocol().NewCodec(&stream)
+	codec.Send(&MyMessage1{"a", 1})
+	codec.Send(&MyMessage2{2, "b"})
+
+	rb := codec.(link.ReadBufferedCodec)
+	if _, err := codec.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	if rb.ReadBuffered() == 0 {
+		t.Fatal("second message not buffered")
+	}
+	if _, err := codec.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	if n := rb.ReadBuffered(); n != 0 {
+		t.Fatalf("trailing newline counted: %d", n)
+	}
+}
@@ -0,0 +1,330 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/FTwOoO/link"
+)
+
+var (
+	ErrInvalidLength     = errors.New("Invalid Length Field")
+	ErrLengthFieldConfig = errors.New("Invalid Length Field Config")
+)
+
+// LengthVarint is the LengthFieldConfig.Size of a varint length, the unsigned
+// base 128 encoding of protobuf and binary.PutUvarint.
+const LengthVarint = -1
+
+// StripHeader is the LengthFieldConfig.Strip that cuts Offset and the length
+// field, whatever size a varint length turns out to have.
+const StripHeader = -1
+
+const defaultLengthFieldMaxFrame = 1 << 20
+
+// LengthFieldConfig describes a frame as Offset bytes, the length field and
+// the bytes the length counts, like Netty's LengthFieldBasedFrameDecoder.
+type LengthFieldConfig struct {
+	// Offset is the number of bytes before the length field, a magic number or a version.
+	Offset int
+	// Size is the length field size from 1 to 8 bytes or LengthVarint.
+	Size int
+	// ByteOrder of a fixed size length field, binary.BigEndian when nil.
+	ByteOrder binary.ByteOrder
+	// Adjustment is added to the length to get the number of bytes after the
+	// field, -(Offset+Size) when the length counts the whole frame.
+	Adjustment int
+	// Strip is the number of bytes cut from the frame start before the base
+	// codec reads it, usually StripHeader. Send always writes the header, so
+	// a shorter Strip only suits receiving.
+	Strip int
+	// Prefix is written as the Offset bytes on Send, zeros when nil.
+	Prefix []byte
+	// MaxFrame limits the whole frame on both sides, 1MB when 0.
+	MaxFrame int
+}
+
+type LengthFieldProtocol struct {
+	base   link.Protocol
+	config LengthFieldConfig
+	little bool
+	pool   BufferPool
+}
+
+func LengthField(base link.Protocol, config LengthFieldConfig) (*LengthFieldProtocol, error) {
+	if config.Offset < 0 || (config.Strip < 0 && config.Strip != StripHeader) || config.MaxFrame < 0 ||
+		(config.Size != LengthVarint && (config.Size < 1 || config.Size > 8)) ||
+		(config.Prefix != nil && len(config.Prefix) != config.Offset) {
+		return nil, ErrLengthFieldConfig
+	}
+	if config.ByteOrder == nil {
+		config.ByteOrder = binary.BigEndian
+	}
+	little, ok := littleEndian(config.ByteOrder)
+	if !ok && config.Size != LengthVarint && !byteOrderSize(config.Size) {
+		return nil, ErrLengthFieldConfig
+	}
+	if config.MaxFrame == 0 {
+		config.MaxFrame = defaultLengthFieldMaxFrame
+	}
+	return &LengthFieldProtocol{
+		base:   base,
+		config: config,
+		little: little,
+		pool:   DefaultPool,
+	}, nil
+}
+
+func (p *LengthFieldProtocol) SetPool(pool BufferPool) {
+	p.pool = pool
+}
+
+func (p *LengthFieldProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	codec := &lengthFieldCodec{
+		p:        p,
+		rw:       rw,
+		head:     make([]byte, p.config.Offset+binary.MaxVarintLen64),
+		sendHead: make([]byte, p.config.Offset+binary.MaxVarintLen64),
+	}
+	codec.stream.pool = p.pool
+	codec.byteReader, _ = rw.(io.ByteReader)
+
+	codec.base, err = codec.stream.newBase(p.base, rw)
+	if err != nil {
+		return
+	}
+	cc = codec
+	return
+}
+
+// encodeLength writes the length field of a frame carrying n bytes after it
+// to head and returns the field size.
+func (p *LengthFieldProtocol) encodeLength(head []byte, n int) (int, error) {
+	length := n - p.config.Adjustment
+	if length < 0 {
+		return 0, ErrInvalidLength
+	}
+
+	if p.config.Size == LengthVarint {
+		return binary.PutUvarint(head, uint64(length)), nil
+	}
+	if p.config.Size < 8 && uint64(length) >= 1<<(8*uint(p.config.Size)) {
+		return 0, ErrTooLargePacket
+	}
+	putUint(head[:p.config.Size], uint64(length), p.config.ByteOrder, p.little)
+	return p.config.Size, nil
+}
+
+// littleEndian tells whether byteOrder puts the low byte first, ok is false
+// for an order that is neither big nor little endian.
+func littleEndian(byteOrder binary.ByteOrder) (little, ok bool) {
+	var b [2]byte
+	byteOrder.PutUint16(b[:], 0x0102)
+	return b == [2]byte{0x02, 0x01}, b == [2]byte{0x01, 0x02} || b == [2]byte{0x02, 0x01}
+}
+
+// byteOrderSize tells whether an n byte integer is written by binary.ByteOrder
+// or needs no order.
+func byteOrderSize(n int) bool {
+	return n == 1 || n == 2 || n == 4 || n == 8
+}
+
+// putUint writes v to all of b with byteOrder when it has a method for the
+// size and byte by byte in the order of little otherwise.
+func putUint(b []byte, v uint64, byteOrder binary.ByteOrder, little bool) {
+	switch len(b) {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		byteOrder.PutUint16(b, uint16(v))
+	case 4:
+		byteOrder.PutUint32(b, uint32(v))
+	case 8:
+		byteOrder.PutUint64(b, v)
+	default:
+		for i := range b {
+			shift := uint(len(b) - 1 - i)
+			if little {
+				shift = uint(i)
+			}
+			b[i] = byte(v >> (8 * shift))
+		}
+	}
+}
+
+func getUint(b []byte, byteOrder binary.ByteOrder, little bool) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(byteOrder.Uint16(b))
+	case 4:
+		return uint64(byteOrder.Uint32(b))
+	case 8:
+		return byteOrder.Uint64(b)
+	}
+	var v uint64
+	for i := range b {
+		if little {
+			v |= uint64(b[i]) << (8 * uint(i))
+		} else {
+			v = v<<8 | uint64(b[i])
+		}
+	}
+	return v
+}
+
+// header writes the prefix and length field of a frame with n bytes after the field.
+func (p *LengthFieldProtocol) header(head []byte, n int) ([]byte, error) {
+	copy(head, p.config.Prefix)
+	for i := len(p.config.Prefix); i < p.config.Offset; i++ {
+		head[i] = 0
+	}
+	size, err := p.encodeLength(head[p.config.Offset:], n)
+	if err != nil {
+		return nil, err
+	}
+	head = head[:p.config.Offset+size]
+	if len(head)+n > p.config.MaxFrame {
+		return nil, ErrTooLargePacket
+	}
+	return head, nil
+}
+
+type lengthFieldCodec struct {
+	p          *LengthFieldProtocol
+	base       link.Codec
+	rw         io.ReadWriter
+	byteReader io.ByteReader
+	head       []byte
+	sendHead   []byte
+	vec        net.Buffers
+	vecArr     [2][]byte
+	stream     fixlenReadWriter
+}
+
+// readUvarint reads a varint length byte by byte from br, or from r when br
+// is nil. Wrap the connection with Bufio to avoid a read per byte.
+func readUvarint(r io.Reader, br io.ByteReader, head []byte) (int, uint64, error) {
+	var b [1]byte
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		if br != nil {
+			var err error
+			if b[0], err = br.ReadByte(); err != nil {
+				return 0, 0, err
+			}
+		} else if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, 0, err
+		}
+		head[i] = b[0]
+		if b[0] < 0x80 {
+			length, _ := binary.Uvarint(head[:i+1])
+			return i + 1, length, nil
+		}
+	}
+	return 0, 0, ErrInvalidLength
+}
+
+func (c *lengthFieldCodec) Receive() (interface{}, error) {
+	config := &c.p.config
+	var size int
+	var length uint64
+	if config.Size == LengthVarint {
+		if _, err := io.ReadFull(c.rw, c.head[:config.Offset]); err != nil {
+			return nil, err
+		}
+		var err error
+		if size, length, err = readUvarint(c.rw, c.byteReader, c.head[config.Offset:]); err != nil {
+			return nil, err
+		}
+	} else {
+		size = config.Size
+		if _, err := io.ReadFull(c.rw, c.head[:config.Offset+size]); err != nil {
+			return nil, err
+		}
+		length = getUint(c.head[config.Offset:config.Offset+size], config.ByteOrder, c.p.little)
+	}
+
+	headLen := config.Offset + size
+	rest := int64(length) + int64(config.Adjustment)
+	if length > 1<<62 || rest < 0 {
+		return nil, ErrInvalidLength
+	}
+	// checked before the frame buffer is taken from the pool
+	if int64(headLen)+rest > int64(config.MaxFrame) {
+		return nil, ErrTooLargePacket
+	}
+	frameLen := headLen + int(rest)
+	strip := config.Strip
+	if strip == StripHeader {
+		strip = headLen
+	}
+	if strip > frameLen {
+		return nil, ErrInvalidLength
+	}
+
+	// the base codec must not keep references to the frame
+	buff := c.p.pool.Get(frameLen)
+	defer c.p.pool.Put(buff)
+	copy(buff.B, c.head[:headLen])
+	if _, err := io.ReadFull(c.rw, buff.B[headLen:]); err != nil {
+		return nil, err
+	}
+	c.stream.recvBuf.Reset(buff.B[strip:])
+	return c.base.Receive()
+}
+
+func (c *lengthFieldCodec) Send(msg interface{}) error {
+	if pe, ok := msg.(*link.PreEncoded); ok {
+		if pe.Protocol != c.p {
+			return link.ErrPreEncodedMismatch
+		}
+		_, err := c.rw.Write(pe.Frame)
+		return err
+	}
+
+	c.stream.sendBuf = c.p.pool.Get(0)
+	defer func() {
+		c.p.pool.Put(c.stream.sendBuf)
+		c.stream.sendBuf = nil
+	}()
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+
+	head, err := c.p.header(c.sendHead, len(c.stream.sendBuf.B))
+	if err != nil {
+		return dropFrame(c.base, err)
+	}
+	c.vec = append(c.vecArr[:0], head, c.stream.sendBuf.B)
+	return writeBuffers(c.rw, c.p.pool, &c.vec)
+}
+
+func (c *lengthFieldCodec) Protocol() link.Protocol {
+	return c.p
+}
+
+func (c *lengthFieldCodec) Encode(msg interface{}) ([]byte, error) {
+	encoder, ok := c.base.(link.Encoder)
+	if !ok {
+		return nil, link.ErrNotEncoder
+	}
+	body, err := encoder.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	head, err := c.p.header(make([]byte, c.p.config.Offset+binary.MaxVarintLen64), len(body))
+	if err != nil {
+		return nil, err
+	}
+	return append(head, body...), nil
+}
+
+func (c *lengthFieldCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func Test_LengthField(t *testing.T) {
+	// a magic number and a length counting the whole frame
+	protocol, err := LengthField(JsonTestProtocol(), LengthFieldConfig{
+		Offset:     2,
+		Size:       3,
+		Adjustment: -5,
+		Strip:      StripHeader,
+		Prefix:     []byte{0xCA, 0xFE},
+		MaxFrame:   1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	JsonTest(t, protocol)
+	PreEncodedTest(t, protocol)
+
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+	codec.Send(&MyMessage1{"abc", 123})
+	frame := stream.Bytes()
+	if !bytes.Equal(frame[:2], []byte{0xCA, 0xFE}) || int(frame[2])<<16|int(frame[3])<<8|int(frame[4]) != len(frame) {
+		t.Fatalf("header not match: % x", frame[:5])
+	}
+}
+
+func Test_LengthFieldVarint(t *testing.T) {
+	protocol, err := LengthField(JsonTestProtocol(), LengthFieldConfig{
+		Offset: 1,
+		Size:   LengthVarint,
+		Strip:  StripHeader,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+	field := bytes.Repeat([]byte("x"), 200)
+	if err := codec.Send(&MyMessage1{string(field), 1}); err != nil {
+		t.Fatal(err)
+	}
+	length, n := binary.Uvarint(stream.Bytes()[1:])
+	if n != 2 || int(length) != stream.Len()-3 {
+		t.Fatalf("varint length not match: %d, %d", length, n)
+	}
+
+	msg, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.(*MyMessage1).Field1 != string(field) {
+		t.Fatalf("message not match: %v", msg)
+	}
+}
+
+func Test_LengthFieldLimit(t *testing.T) {
+	if _, err := LengthField(JsonTestProtocol(), LengthFieldConfig{Size: 5, Prefix: []byte{1}}); err != ErrLengthFieldConfig {
+		t.Fatalf("bad config not rejected: %v", err)
+	}
+
+	protocol, _ := LengthField(JsonTestProtocol(), LengthFieldConfig{
+		Size:      2,
+		ByteOrder: binary.LittleEndian,
+		Strip:     StripHeader,
+		MaxFrame:  16,
+	})
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+	if err := codec.Send(&MyMessage1{"abc", 123}); err != ErrTooLargePacket {
+		t.Fatalf("large frame sent: %v", err)
+	}
+
+	stream.Write([]byte{0xff, 0x00})
+	if _, err := codec.Receive(); err != ErrTooLargePacket {
+		t.Fatalf("large frame received: %v", err)
+	}
+}
+
+// wrappedOrder is a ByteOrder the codecs can't compare to binary.LittleEndian.
+type wrappedOrder struct {
+	binary.ByteOrder
+}
+
+func Test_LengthFieldByteOrder(t *testing.T) {
+	for _, size := range []int{2, 3} {
+		protocol, err := LengthField(JsonTestProtocol(), LengthFieldConfig{
+			Size:      size,
+			ByteOrder: wrappedOrder{binary.LittleEndian},
+			Strip:     StripHeader,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stream bytes.Buffer
+		codec, _ := protocol.NewCodec(&stream)
+		codec.Send(&MyMessage1{"abc", 123})
+		if int(stream.Bytes()[0]) != stream.Len()-size || stream.Bytes()[size-1] != 0 {
+			t.Fatalf("length not little endian: % x", stream.Bytes()[:size])
+		}
+		if _, err := codec.Receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_LengthFieldHugeLength(t *testing.T) {
+	protocol, _ := LengthField(JsonTestProtocol(), LengthFieldConfig{Size: 8, Strip: StripHeader})
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+	stream.Write([]byte{0x3f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if _, err := codec.Receive(); err != ErrTooLargePacket {
+		t.Fatalf("huge frame not rejected: %v", err)
+	}
+}
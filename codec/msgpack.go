@@ -0,0 +1,212 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+
+	"github.com/FTwOoO/link"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// MsgPackProtocol sends a message as a MessagePack array of the head and the
+// body, like Json. The head is the registered name, or the id of a type
+// registered with RegisterID, or nil for an unregistered type.
+type MsgPackProtocol struct {
+	types   map[string]reflect.Type
+	names   map[reflect.Type]string
+	ids     map[int64]reflect.Type
+	typeIDs map[reflect.Type]int64
+}
+
+func MsgPack() *MsgPackProtocol {
+	return &MsgPackProtocol{
+		types:   make(map[string]reflect.Type),
+		names:   make(map[reflect.Type]string),
+		ids:     make(map[int64]reflect.Type),
+		typeIDs: make(map[reflect.Type]int64),
+	}
+}
+
+func (m *MsgPackProtocol) Register(t interface{}) {
+	rt := reflect.TypeOf(t)
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	name := rt.PkgPath() + "/" + rt.Name()
+	m.types[name] = rt
+	m.names[rt] = name
+}
+
+func (m *MsgPackProtocol) RegisterName(name string, t interface{}) {
+	rt := reflect.TypeOf(t)
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	m.types[name] = rt
+	m.names[rt] = name
+}
+
+// RegisterID sends the type with an integer head, which takes 1 byte for ids
+// from 0 to 127 instead of the length of a name.
+func (m *MsgPackProtocol) RegisterID(id int64, t interface{}) {
+	rt := reflect.TypeOf(t)
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	m.ids[id] = rt
+	m.typeIDs[rt] = id
+}
+
+// MessageTypes returns the registered types as Receive returns them, as pointers.
+func (m *MsgPackProtocol) MessageTypes() []reflect.Type {
+	types := make([]reflect.Type, 0, len(m.names)+len(m.typeIDs))
+	for t := range m.names {
+		types = append(types, reflect.PtrTo(t))
+	}
+	for t := range m.typeIDs {
+		if _, named := m.names[t]; !named {
+			types = append(types, reflect.PtrTo(t))
+		}
+	}
+	return types
+}
+
+func (m *MsgPackProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	codec := &msgpackCodec{
+		p: m,
+		w: rw,
+	}
+	// a reader with UnreadByte is used as is, Bufio counts what it buffers
+	var r io.Reader = rw
+	if _, ok := rw.(io.ByteScanner); !ok {
+		codec.reader = bufio.NewReader(rw)
+		r = codec.reader
+	}
+	codec.decoder = msgpack.NewDecoder(r)
+	codec.encoder = msgpack.NewEncoder(&codec.buf)
+	codec.encoder.UseCompactInts(true)
+	codec.closer, _ = rw.(io.Closer)
+	return codec, nil
+}
+
+type msgpackCodec struct {
+	p       *MsgPackProtocol
+	w       io.Writer
+	closer  io.Closer
+	reader  *bufio.Reader
+	decoder *msgpack.Decoder
+	encoder *msgpack.Encoder
+	buf     bytes.Buffer
+}
+
+// readType decodes the head and returns the registered type, nil when there is none.
+func (c *msgpackCodec) readType() (reflect.Type, error) {
+	code, err := c.decoder.PeekCode()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case code == msgpcode.Nil:
+		return nil, c.decoder.DecodeNil()
+	case msgpcode.IsString(code):
+		name, err := c.decoder.DecodeString()
+		return c.p.types[name], err
+	}
+	id, err := c.decoder.DecodeInt64()
+	return c.p.ids[id], err
+}
+
+func (c *msgpackCodec) Receive() (interface{}, error) {
+	n, err := c.decoder.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	if n != 2 {
+		return nil, ErrInvalidLength
+	}
+	t, err := c.readType()
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return c.decoder.DecodeInterface()
+	}
+	body := reflect.New(t).Interface()
+	if err := c.decoder.Decode(body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (c *msgpackCodec) encode(encoder *msgpack.Encoder, msg interface{}) error {
+	t := reflect.TypeOf(msg)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if err := encoder.EncodeArrayLen(2); err != nil {
+		return err
+	}
+	var err error
+	if id, exists := c.p.typeIDs[t]; exists {
+		err = encoder.EncodeInt(id)
+	} else if name, exists := c.p.names[t]; exists {
+		err = encoder.EncodeString(name)
+	} else {
+		err = encoder.EncodeNil()
+	}
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(msg)
+}
+
+func (c *msgpackCodec) Send(msg interface{}) error {
+	if pe, ok := msg.(*link.PreEncoded); ok {
+		if pe.Protocol != c.p {
+			return link.ErrPreEncodedMismatch
+		}
+		_, err := c.w.Write(pe.Frame)
+		return err
+	}
+
+	// one write per message, the encoder writes a few bytes at a time
+	c.buf.Reset()
+	if err := c.encode(c.encoder, msg); err != nil {
+		return err
+	}
+	_, err := c.w.Write(c.buf.Bytes())
+	return err
+}
+
+func (c *msgpackCodec) ReadBuffered() int {
+	if c.reader != nil {
+		return c.reader.Buffered()
+	}
+	return 0
+}
+
+func (c *msgpackCodec) Protocol() link.Protocol {
+	return c.p
+}
+
+func (c *msgpackCodec) Encode(msg interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(encoder)
+	encoder.Reset(&buf)
+	encoder.UseCompactInts(true)
+	if err := c.encode(encoder, msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *msgpackCodec) Close() error {
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
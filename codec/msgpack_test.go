@@ -0,0 +1,53 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func MsgPackTestProtocol() *MsgPackProtocol {
+	protocol := MsgPack()
+	protocol.Register(MyMessage1{})
+	protocol.RegisterName("msg2", &MyMessage2{})
+	return protocol
+}
+
+func Test_MsgPack(t *testing.T) {
+	protocol := MsgPackTestProtocol()
+	JsonTest(t, protocol)
+	PreEncodedTest(t, protocol)
+
+	framed, err := FixLen(protocol, 2, binary.LittleEndian, 1024, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	JsonTest(t, framed)
+}
+
+func Test_MsgPackID(t *testing.T) {
+	named := MsgPackTestProtocol()
+	numbered := MsgPackTestProtocol()
+	numbered.RegisterID(1, MyMessage1{})
+	JsonTest(t, numbered)
+
+	var stream1, stream2 bytes.Buffer
+	codec1, _ := named.NewCodec(&stream1)
+	codec2, _ := numbered.NewCodec(&stream2)
+	codec1.Send(&MyMessage1{"abc", 123})
+	codec2.Send(&MyMessage1{"abc", 123})
+	if stream2.Len() >= stream1.Len() {
+		t.Fatalf("integer head not smaller: %d, %d", stream2.Len(), stream1.Len())
+	}
+
+	msg, err := codec2.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *msg.(*MyMessage1) != (MyMessage1{"abc", 123}) {
+		t.Fatalf("message not match: %v", msg)
+	}
+	if len(numbered.MessageTypes()) != 2 {
+		t.Fatalf("message types not match: %v", numbered.MessageTypes())
+	}
+}
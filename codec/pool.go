@@ -0,0 +1,89 @@
+package codec
+
+import (
+	"errors"
+	"sync"
+)
+
+// Buffer is a byte slice borrowed from a BufferPool.
+type Buffer struct {
+	B []byte
+}
+
+// BufferPool hands out buffers for encoding and decoding frames, codecs
+// return a buffer as soon as the frame is written or decoded.
+type BufferPool interface {
+	// Get returns a buffer with len(B) == size.
+	Get(size int) *Buffer
+	Put(*Buffer)
+}
+
+var DefaultPool BufferPool = newSyncPool(64, 64*1024)
+
+var ErrPoolSize = errors.New("Invalid Pool Size")
+
+type syncPool struct {
+	classes []sync.Pool
+	sizes   []int
+}
+
+// NewSyncPool creates a BufferPool of power of two size classes from minSize
+// to maxSize, larger buffers are allocated on demand and not kept. minSize
+// must be positive and not above maxSize.
+func NewSyncPool(minSize, maxSize int) (BufferPool, error) {
+	if minSize <= 0 || minSize > maxSize {
+		return nil, ErrPoolSize
+	}
+	return newSyncPool(minSize, maxSize), nil
+}
+
+func newSyncPool(minSize, maxSize int) *syncPool {
+	p := &syncPool{}
+	for size := minSize; size <= maxSize; size *= 2 {
+		p.sizes = append(p.sizes, size)
+		if size > maxSize/2 {
+			// doubling again would overflow near math.MaxInt
+			break
+		}
+	}
+	p.classes = make([]sync.Pool, len(p.sizes))
+	for i := range p.classes {
+		size := p.sizes[i]
+		p.classes[i].New = func() interface{} {
+			return &Buffer{B: make([]byte, 0, size)}
+		}
+	}
+	return p
+}
+
+func (p *syncPool) Get(size int) *Buffer {
+	for i, classSize := range p.sizes {
+		if size <= classSize {
+			buf := p.classes[i].Get().(*Buffer)
+			buf.B = buf.B[:size]
+			return buf
+		}
+	}
+	return &Buffer{B: make([]byte, size)}
+}
+
+func (p *syncPool) Put(buf *Buffer) {
+	for i, classSize := range p.sizes {
+		if cap(buf.B) == classSize {
+			buf.B = buf.B[:0]
+			p.classes[i].Put(buf)
+			return
+		}
+	}
+}
+
+// grow makes room for n more bytes in buf, moving it to a larger buffer from the pool when needed.
+func grow(pool BufferPool, buf *Buffer, n int) *Buffer {
+	if len(buf.B)+n <= cap(buf.B) {
+		return buf
+	}
+	newBuf := pool.Get(2*len(buf.B) + n)
+	newBuf.B = newBuf.B[:copy(newBuf.B, buf.B)]
+	pool.Put(buf)
+	return newBuf
+}
@@ -0,0 +1,56 @@
+package codec
+
+import (
+	"math"
+	"testing"
+)
+
+func Test_SyncPool(t *testing.T) {
+	pool, err := NewSyncPool(64, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := pool.Get(100)
+	if len(buf.B) != 100 || cap(buf.B) != 128 {
+		t.Fatalf("buffer size not match: %d, %d", len(buf.B), cap(buf.B))
+	}
+	pool.Put(buf)
+
+	large := pool.Get(4096)
+	if len(large.B) != 4096 {
+		t.Fatalf("buffer size not match: %d", len(large.B))
+	}
+	pool.Put(large)
+
+	buf = pool.Get(10)
+	buf.B = append(buf.B[:0], "abc"...)
+	buf = grow(pool, buf, 100)
+	if string(buf.B) != "abc" || cap(buf.B) < 103 {
+		t.Fatalf("grow lost data: %q, %d", buf.B, cap(buf.B))
+	}
+}
+
+func Test_SyncPoolSizes(t *testing.T) {
+	for _, sizes := range [][2]int{{0, 1024}, {-1, 1024}, {2048, 1024}} {
+		if _, err := NewSyncPool(sizes[0], sizes[1]); err != ErrPoolSize {
+			t.Fatalf("sizes %v not rejected: %v", sizes, err)
+		}
+	}
+	// the classes stop before doubling overflows
+	pool, err := NewSyncPool(1<<40, math.MaxInt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes := pool.(*syncPool).sizes; len(sizes) != 23 || sizes[22] != 1<<62 {
+		t.Fatalf("size classes not match: %v", sizes)
+	}
+}
+
+func Benchmark_SyncPool(b *testing.B) {
+	pool, _ := NewSyncPool(64, 64*1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pool.Put(pool.Get(1000))
+	}
+}
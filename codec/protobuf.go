@@ -1,131 +1,684 @@
 package codec
 
 import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"hash"
+	"hash/crc32"
 	"io"
 	"math"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"github.com/cespare/xxhash/v2"
 	"github.com/golang/protobuf/proto"
+	protoV2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 	"github.com/FTwOoO/link"
 	"fmt"
 )
 
+const (
+	protobufHeaderSize     = 12
+	protobufHeaderSizeV2   = 15
+	protobufHeaderSizeName = 14
+)
+
+const (
+	// ProtobufHeaderV1 is type, size and hash in 12 bytes, bodies are limited
+	// to 64 KiB. It has no version byte, so a peer using another version is not
+	// always detected and both sides must be configured with the same version.
+	ProtobufHeaderV1 = 1
+	// ProtobufHeaderV2 starts with the version byte 2 and has a 32 bit size in 15 bytes.
+	ProtobufHeaderV2 = 2
+	// ProtobufHeaderName starts with the version byte 3 and names the message
+	// by its protobuf full name, so no id list is shared. Registered messages
+	// and those of SetNamePackages are received, both sides must use it. The
+	// codec writes nothing before the first message, so it works under any
+	// wrapper of this package. See SetNameTable.
+	ProtobufHeaderName = 3
+)
+
+// kinds of the name section after a ProtobufHeaderName header
+const (
+	// nameInline is a 2 byte length and the full name
+	nameInline byte = iota
+	// nameDefine is a 2 byte table index before the inline name, the receiver remembers it
+	nameDefine
+	// nameRef is a 2 byte index of a name defined earlier on the connection
+	nameRef
+	// nameAnnounce has no name or body, the content size is the name table size
+	// of the sender. It goes before the first message a codec sends.
+	nameAnnounce
+)
+
+var ErrHeaderVersion = errors.New("Unsupported Header Version")
+
 type protobufPacketHeader struct {
+	Version     int
 	MessageType uint16
-	ContentSize uint16
+	ContentSize uint32
 	Hash        uint64
+
+	// Kind and Name are the raw name section of a ProtobufHeaderName packet
+	Kind byte
+	Name []byte
 }
 
 func (d *protobufPacketHeader) HeaderSize() int {
-	return binary.Size(d.MessageType) + binary.Size(d.ContentSize) + binary.Size(d.Hash)
+	return headerSize(d.Version)
 }
 
+func headerSize(version int) int {
+	switch version {
+	case ProtobufHeaderV2:
+		return protobufHeaderSizeV2
+	case ProtobufHeaderName:
+		return protobufHeaderSizeName
+	}
+	return protobufHeaderSize
+}
+
+// FromBytes decodes a header of d.Version. V2 and name headers are rejected
+// with ErrHeaderVersion when the version byte differs, a V1 header of an id
+// whose high byte happens to match is not.
 func (d *protobufPacketHeader) FromBytes(b []byte) (error) {
 	if len(b) < d.HeaderSize() {
 		return errors.New("Need more data")
 	}
 
+	if d.Version == ProtobufHeaderV2 {
+		if b[0] != ProtobufHeaderV2 {
+			return ErrHeaderVersion
+		}
+		d.MessageType = binary.BigEndian.Uint16(b[1:3])
+		d.ContentSize = binary.BigEndian.Uint32(b[3:7])
+		d.Hash = binary.BigEndian.Uint64(b[7:])
+		return nil
+	}
+	if d.Version == ProtobufHeaderName {
+		if b[0] != ProtobufHeaderName {
+			return ErrHeaderVersion
+		}
+		d.Kind = b[1]
+		d.ContentSize = binary.BigEndian.Uint32(b[2:6])
+		d.Hash = binary.BigEndian.Uint64(b[6:])
+		return nil
+	}
 	d.MessageType = binary.BigEndian.Uint16(b[:2])
-	d.ContentSize = binary.BigEndian.Uint16(b[2:4])
+	d.ContentSize = uint32(binary.BigEndian.Uint16(b[2:4]))
 	d.Hash = binary.BigEndian.Uint64(b[4:])
 	return nil
 }
 
 func (d *protobufPacketHeader) ToBytes() []byte {
 	buf := make([]byte, d.HeaderSize())
+	d.PutBytes(buf)
+	return buf
+}
+
+func (d *protobufPacketHeader) PutBytes(buf []byte) {
+	if d.Version == ProtobufHeaderV2 {
+		buf[0] = ProtobufHeaderV2
+		binary.BigEndian.PutUint16(buf[1:3], d.MessageType)
+		binary.BigEndian.PutUint32(buf[3:7], d.ContentSize)
+		binary.BigEndian.PutUint64(buf[7:], d.Hash)
+		return
+	}
+	if d.Version == ProtobufHeaderName {
+		buf[0] = ProtobufHeaderName
+		buf[1] = d.Kind
+		binary.BigEndian.PutUint32(buf[2:6], d.ContentSize)
+		binary.BigEndian.PutUint64(buf[6:], d.Hash)
+		return
+	}
 	binary.BigEndian.PutUint16(buf[:2], d.MessageType)
-	binary.BigEndian.PutUint16(buf[2:4], d.ContentSize)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(d.ContentSize))
 	binary.BigEndian.PutUint64(buf[4:], d.Hash)
-	return buf
 }
 
-func (d *protobufPacketHeader) ValidateContent(body []byte) error {
+// ValidateContent checks the Hash against body, a nil hasher accepts any Hash.
+func (d *protobufPacketHeader) ValidateContent(body []byte, hasher *packetHasher) error {
+	if hasher == nil {
+		return nil
+	}
+	// t escapes into the hash, declared here it isn't allocated without one
+	var t [2]byte
+	if d.Hash != hasher.sum(d.typePrefix(&t), body) {
+		return ErrHashMismatch
+	}
 	return nil
 }
 
+// typePrefix returns the bytes naming the message type, they are hashed with the body.
+func (d *protobufPacketHeader) typePrefix(t *[2]byte) []byte {
+	if d.Version == ProtobufHeaderName {
+		return d.Name
+	}
+	binary.BigEndian.PutUint16(t[:], d.MessageType)
+	return t[:]
+}
+
+// HashAlgorithm is how the Hash of a packet header is computed over the
+// message type or name and body.
+type HashAlgorithm int
+
+const (
+	HashNone HashAlgorithm = iota
+	HashCRC32C
+	HashXXH64
+	// HashHMAC is HMAC-SHA256 with a shared key truncated to 64 bits, it also
+	// stops peers without the key from forging packets.
+	HashHMAC
+)
+
+var (
+	ErrHashMismatch    = errors.New("Packet Hash Mismatch")
+	ErrUnsupportedHash = errors.New("Unsupported Hash Algorithm")
+	crc32cTable        = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type packetHasher struct {
+	algo HashAlgorithm
+	hmac sync.Pool
+}
+
+func newPacketHasher(algo HashAlgorithm, key []byte) (*packetHasher, error) {
+	switch algo {
+	case HashNone:
+		return nil, nil
+	case HashCRC32C, HashXXH64:
+		return &packetHasher{algo: algo}, nil
+	case HashHMAC:
+		if len(key) == 0 {
+			return nil, ErrUnsupportedHash
+		}
+		key = append([]byte(nil), key...)
+		h := &packetHasher{algo: algo}
+		h.hmac.New = func() interface{} {
+			return hmac.New(sha256.New, key)
+		}
+		return h, nil
+	}
+	return nil, ErrUnsupportedHash
+}
+
+func (h *packetHasher) sum(prefix []byte, body []byte) uint64 {
+	switch h.algo {
+	case HashCRC32C:
+		return uint64(crc32.Update(crc32.Update(0, crc32cTable, prefix), crc32cTable, body))
+	case HashXXH64:
+		var d xxhash.Digest
+		d.Reset()
+		d.Write(prefix)
+		d.Write(body)
+		return d.Sum64()
+	default:
+		mac := h.hmac.Get().(hash.Hash)
+		mac.Reset()
+		mac.Write(prefix)
+		mac.Write(body)
+		var sum [sha256.Size]byte
+		mac.Sum(sum[:0])
+		h.hmac.Put(mac)
+		return binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
 type ProtobufProtocol struct {
-	maxRecv        int
-	maxSend        int
+	mutex          sync.RWMutex
+	config         protobufConfig
 	valueToMsgType map[uint16]reflect.Type
 	msgTypeToValue map[reflect.Type]uint16
+	nameToMsgType  map[protoreflect.FullName]reflect.Type
 	context        interface{}
+	pool           BufferPool
 }
 
-func NewProtobufProtocol(msgTypes []reflect.Type) *ProtobufProtocol {
+// protobufConfig is set by SetHash, SetHeader and SetNameTable, a codec
+// copies it when it is created.
+type protobufConfig struct {
+	version       int
+	maxRecv       int
+	maxSend       int
+	nameTableSize int
+	namePackages  []string
+	hasher        *packetHasher
+}
+
+var (
+	ErrNotMessage    = errors.New("Not A Protobuf Message")
+	ErrUnknownType   = errors.New("Unknown Message Type")
+	ErrUnknownID     = errors.New("Unknown Message ID")
+	ErrContentSize   = errors.New("Content Size Mismatch")
+	ErrDuplicateID   = errors.New("Duplicate Message ID")
+	ErrDuplicateType = errors.New("Duplicate Message Type")
+	ErrUnknownName   = errors.New("Unknown Message Name")
+)
+
+// NewProtobufProtocol uses the index in msgTypes as wire id, which changes when
+// the list is reordered. Pass nil and Register each message for stable ids.
+// Messages of github.com/golang/protobuf and google.golang.org/protobuf are
+// supported, a type that is neither fails with ErrNotMessage.
+func NewProtobufProtocol(msgTypes []reflect.Type) (*ProtobufProtocol, error) {
 	p := &ProtobufProtocol{}
 
-	p.maxRecv = math.MaxUint16
-	p.maxSend = math.MaxUint16
+	p.config.version = ProtobufHeaderV1
+	p.config.maxRecv = math.MaxUint16
+	p.config.maxSend = math.MaxUint16
+	p.pool = DefaultPool
 	p.valueToMsgType = map[uint16]reflect.Type{}
 	p.msgTypeToValue = map[reflect.Type]uint16{}
+	p.nameToMsgType = map[protoreflect.FullName]reflect.Type{}
 
 	for i, t := range msgTypes {
-		if t.Kind() != reflect.Ptr {
-			// protobuf's Message type must be pointer
-			return nil
+		if err := p.registerType(uint16(i), t); err != nil {
+			return nil, err
 		}
-		p.valueToMsgType[uint16(i)] = t
+	}
+	return p, nil
+}
 
-		p.msgTypeToValue[t] = uint16(i)
+// messageV2 returns msg as a google.golang.org/protobuf message, msg may use either API.
+func messageV2(msg interface{}) (protoV2.Message, bool) {
+	switch m := msg.(type) {
+	case protoV2.Message:
+		return m, true
+	case proto.Message:
+		return proto.MessageV2(m), true
 	}
-	return p
+	return nil, false
 }
 
-func (d *ProtobufProtocol) EncodeMessage(msg proto.Message) (packet []byte, err error) {
-	body, err := proto.Marshal(msg)
-	if err != nil {
-		return nil, err
+func (d *ProtobufProtocol) registerType(id uint16, t reflect.Type) error {
+	// protobuf's Message type must be pointer
+	if t == nil || t.Kind() != reflect.Ptr {
+		return fmt.Errorf("%w: %v", ErrNotMessage, t)
+	}
+	m, ok := messageV2(reflect.New(t.Elem()).Interface())
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrNotMessage, t)
 	}
 
-	h := new(protobufPacketHeader)
-	if _, ok := d.msgTypeToValue[reflect.TypeOf(msg)]; !ok {
-		fmt.Printf("No message type for this type %s", reflect.TypeOf(msg))
-		return nil, fmt.Errorf("No message type for this type %s", reflect.TypeOf(msg))
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, exists := d.valueToMsgType[id]; exists {
+		return fmt.Errorf("%w: %d", ErrDuplicateID, id)
+	}
+	if _, exists := d.msgTypeToValue[t]; exists {
+		return fmt.Errorf("%w: %s", ErrDuplicateType, t)
 	}
+	d.valueToMsgType[id] = t
+	d.msgTypeToValue[t] = id
+	d.nameToMsgType[m.ProtoReflect().Descriptor().FullName()] = t
+	return nil
+}
 
-	h.MessageType = d.msgTypeToValue[reflect.TypeOf(msg)]
-	h.ContentSize = uint16(len(body))
-	h.Hash = 0
+func (d *ProtobufProtocol) typeOf(id uint16) (reflect.Type, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	t, exists := d.valueToMsgType[id]
+	return t, exists
+}
+
+func (d *ProtobufProtocol) typeOfName(name protoreflect.FullName) (reflect.Type, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	t, exists := d.nameToMsgType[name]
+	return t, exists
+}
 
+func (d *ProtobufProtocol) idOf(t reflect.Type) (uint16, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	id, exists := d.msgTypeToValue[t]
+	return id, exists
+}
+
+// Register maps msg to a wire id. Unlike the index of NewProtobufProtocol the
+// id stays put when types are added or reordered, an id must never be reused
+// for another message. msg is a message of either protobuf API, Register is
+// safe to call while codecs are in use.
+func (d *ProtobufProtocol) Register(id uint16, msg interface{}) error {
+	return d.registerType(id, reflect.TypeOf(msg))
+}
+
+// LoadManifest registers the messages listed in a manifest, one "id full.name"
+// per line with # comments. The messages must be linked in, a manifest can be
+// generated from the message options of .proto files or written by WriteManifest.
+func (d *ProtobufProtocol) LoadManifest(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("manifest line %d: want \"id name\"", line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("manifest line %d: %v", line, err)
+		}
+		t := proto.MessageType(fields[1])
+		if t == nil {
+			return fmt.Errorf("manifest line %d: %w: %s", line, ErrUnknownName, fields[1])
+		}
+		if err = d.registerType(uint16(id), t); err != nil {
+			return fmt.Errorf("manifest line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// WriteManifest writes the registered messages sorted by id in the LoadManifest format.
+func (d *ProtobufProtocol) WriteManifest(w io.Writer) error {
+	names := d.messageNames()
+	ids := make([]int, 0, len(names))
+	for id := range names {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if _, err := fmt.Fprintf(w, "%d %s\n", id, names[uint16(id)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *ProtobufProtocol) messageNames() map[uint16]string {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	names := make(map[uint16]string, len(d.valueToMsgType))
+	for id, t := range d.valueToMsgType {
+		m, _ := messageV2(reflect.New(t.Elem()).Interface())
+		names[id] = string(m.ProtoReflect().Descriptor().FullName())
+	}
+	return names
+}
+
+// IncompatibleError lists the conflicts found by CheckCompatible.
+type IncompatibleError struct {
+	Conflicts []string
+}
+
+func (e *IncompatibleError) Error() string {
+	return "incompatible message ids: " + strings.Join(e.Conflicts, "; ")
+}
+
+// CheckCompatible compares two registries, for example the one built at
+// startup and one loaded from the manifest of a deployed version. An id used
+// for different messages or a message under different ids is a conflict, ids
+// only one side knows are fine.
+func (d *ProtobufProtocol) CheckCompatible(other *ProtobufProtocol) error {
+	names, otherNames := d.messageNames(), other.messageNames()
+	otherIDs := make(map[string]uint16, len(otherNames))
+	for id, name := range otherNames {
+		otherIDs[name] = id
+	}
+
+	var conflicts []string
+	for id, name := range names {
+		if otherName, exists := otherNames[id]; exists && otherName != name {
+			conflicts = append(conflicts, fmt.Sprintf("id %d is %s and %s", id, name, otherName))
+		}
+		if otherID, exists := otherIDs[name]; exists && otherID != id {
+			conflicts = append(conflicts, fmt.Sprintf("%s is id %d and %d", name, id, otherID))
+		}
+	}
+	if conflicts != nil {
+		sort.Strings(conflicts)
+		return &IncompatibleError{conflicts}
+	}
+	return nil
+}
+
+// MessageTypes returns the registered message types, they are pointers as Receive returns them.
+func (d *ProtobufProtocol) MessageTypes() []reflect.Type {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	types := make([]reflect.Type, 0, len(d.msgTypeToValue))
+	for t := range d.msgTypeToValue {
+		types = append(types, t)
+	}
+	return types
+}
+
+func (d *ProtobufProtocol) getConfig() protobufConfig {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.config
+}
+
+// SetHash sets how packet hashes are computed and checked, key is only used
+// by HashHMAC. Both sides must use the same algorithm, a packet failing the
+// check fails Receive with ErrHashMismatch and the session should be closed.
+// Like SetHeader and SetNameTable it applies to codecs created afterwards.
+func (d *ProtobufProtocol) SetHash(algo HashAlgorithm, key []byte) error {
+	hasher, err := newPacketHasher(algo, key)
 	if err != nil {
-		return
+		return err
+	}
+	d.mutex.Lock()
+	d.config.hasher = hasher
+	d.mutex.Unlock()
+	return nil
+}
+
+// SetHeader picks the header version and the body size limits, which are
+// capped to what the header can hold. Both sides must use the same version.
+func (d *ProtobufProtocol) SetHeader(version int, maxRecv, maxSend int) error {
+	max := uint64(math.MaxUint16)
+	switch version {
+	case ProtobufHeaderV1:
+	case ProtobufHeaderV2, ProtobufHeaderName:
+		max = math.MaxUint32
+	default:
+		return ErrHeaderVersion
+	}
+	if uint64(maxRecv) > max {
+		maxRecv = int(max)
+	}
+	if uint64(maxSend) > max {
+		maxSend = int(max)
 	}
+	d.mutex.Lock()
+	d.config.version = version
+	d.config.maxRecv = maxRecv
+	d.config.maxSend = maxSend
+	d.mutex.Unlock()
+	return nil
+}
 
-	header := h.ToBytes()
-	packet = make([]byte, len(header) + len(body))
-	copy(packet, header)
-	copy(packet[len(header):], body)
+// SetNameTable lets a ProtobufHeaderName codec send the first size distinct
+// names of a connection once and refer to them by a 2 byte index afterwards.
+// Each codec announces its size with its first message, a codec sends names
+// inline until it received the announcement and uses the smaller size then.
+func (d *ProtobufProtocol) SetNameTable(size int) {
+	if size > math.MaxUint16+1 {
+		size = math.MaxUint16 + 1
+	}
+	d.mutex.Lock()
+	d.config.nameTableSize = size
+	d.mutex.Unlock()
+}
+
+// SetNamePackages lets a ProtobufHeaderName codec receive the linked messages
+// of packages and their subpackages without registering them. Other names
+// fail with ErrUnknownName, so a peer can't make the codec build any message
+// linked into the program.
+func (d *ProtobufProtocol) SetNamePackages(packages ...string) {
+	d.mutex.Lock()
+	d.config.namePackages = append([]string{}, packages...)
+	d.mutex.Unlock()
+}
+
+// namedType returns the type received for name, the registered one or one
+// of the allowed packages from the global registry.
+func (d *ProtobufProtocol) namedType(config *protobufConfig, name protoreflect.FullName) (protoreflect.MessageType, bool) {
+	if t, ok := d.typeOfName(name); ok {
+		m, _ := messageV2(reflect.New(t.Elem()).Interface())
+		return m.ProtoReflect().Type(), true
+	}
+	for _, pkg := range config.namePackages {
+		if strings.HasPrefix(string(name), pkg+".") {
+			mt, err := protoregistry.GlobalTypes.FindMessageByName(name)
+			return mt, err == nil
+		}
+	}
+	return nil, false
+}
+
+func (d *ProtobufProtocol) SetPool(pool BufferPool) {
+	d.pool = pool
+}
+
+// EncodeMessage returns the packet of msg, a message of either protobuf API.
+func (d *ProtobufProtocol) EncodeMessage(msg interface{}) (packet []byte, err error) {
+	config := d.getConfig()
+	return d.encodeMessage(&config, msg)
+}
+
+func (d *ProtobufProtocol) encodeMessage(config *protobufConfig, msg interface{}) (packet []byte, err error) {
+	m, ok := messageV2(msg)
+	if !ok {
+		return nil, ErrNotMessage
+	}
+	size := headerSize(config.version)
+	_, packet, err = d.encodePacket(config, make([]byte, size, size+protoV2.Size(m)), msg, m, nil)
 	return
 }
 
+// encodePacket marshals msg after the last header size bytes in buf and fills
+// the header in place, so the packet is built without copying. It returns buf
+// with the packet appended and the packet. names is the name table of the
+// sending codec, nil writes names inline.
+func (d *ProtobufProtocol) encodePacket(config *protobufConfig, buf []byte, msg interface{}, m protoV2.Message, names *nameTable) ([]byte, []byte, error) {
+	if config.version == ProtobufHeaderName {
+		return d.encodeNamed(config, buf, m, names)
+	}
+
+	size := headerSize(config.version)
+	start := len(buf) - size
+	h := &protobufPacketHeader{Version: config.version}
+	id, ok := d.idOf(reflect.TypeOf(msg))
+	if !ok {
+		return buf, nil, fmt.Errorf("%w: %T", ErrUnknownType, msg)
+	}
+
+	buf, err := protoV2.MarshalOptions{}.MarshalAppend(buf, m)
+	if err != nil {
+		return buf, nil, err
+	}
+	packet := buf[start:]
+
+	h.MessageType = id
+	if len(packet)-size > config.maxSend {
+		return buf, nil, ErrTooLargePacket
+	}
+	h.ContentSize = uint32(len(packet) - size)
+	if config.hasher != nil {
+		var t [2]byte
+		h.Hash = config.hasher.sum(h.typePrefix(&t), packet[size:])
+	}
+	h.PutBytes(packet)
+	return buf, packet, nil
+}
+
 func (d *ProtobufProtocol) DecodeHeader(header []byte) (h *protobufPacketHeader, err error) {
 
-	h = new(protobufPacketHeader)
+	h = &protobufPacketHeader{Version: d.getConfig().version}
 	err = h.FromBytes(header)
 	return
 }
 
-func (d *ProtobufProtocol) DecodeBody(body []byte, h *protobufPacketHeader) (msg proto.Message, err error) {
-	if len(body) != int(h.ContentSize) {
-		return nil, errors.New("Content size dont match")
+// nameTable is the names a codec defined for its peer, at most size of them.
+type nameTable struct {
+	ids  map[string]uint16
+	size int
+}
+
+func (d *ProtobufProtocol) encodeNamed(config *protobufConfig, buf []byte, m protoV2.Message, names *nameTable) ([]byte, []byte, error) {
+	start := len(buf) - protobufHeaderSizeName
+	h := &protobufPacketHeader{Version: ProtobufHeaderName, Kind: nameInline}
+	name := string(m.ProtoReflect().Descriptor().FullName())
+
+	var index uint16
+	var defined bool
+	if names != nil {
+		index, defined = names.ids[name]
+	}
+	if defined {
+		h.Kind = nameRef
+		buf = binary.BigEndian.AppendUint16(buf, index)
+	} else if names != nil && len(names.ids) < names.size {
+		h.Kind = nameDefine
+		index = uint16(len(names.ids))
+		buf = binary.BigEndian.AppendUint16(buf, index)
 	}
+	if !defined {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(name)))
+		buf = append(buf, name...)
+	}
+	bodyStart := len(buf)
 
-	if err := h.ValidateContent(body); err != nil {
-		return nil, err
+	buf, err := protoV2.MarshalOptions{}.MarshalAppend(buf, m)
+	if err != nil {
+		return buf, nil, err
+	}
+	packet := buf[start:]
+	body := buf[bodyStart:]
+	if len(body) > config.maxSend {
+		return buf, nil, ErrTooLargePacket
 	}
 
-	if _, ok := d.valueToMsgType[h.MessageType]; !ok {
-		return nil, errors.New("Invalid type")
+	h.ContentSize = uint32(len(body))
+	h.Name = buf[start+protobufHeaderSizeName : bodyStart]
+	if config.hasher != nil {
+		h.Hash = config.hasher.sum(h.Name, body)
 	}
+	h.PutBytes(packet)
+	if h.Kind == nameDefine {
+		names.ids[name] = index
+	}
+	return buf, packet, nil
+}
 
-	T := d.valueToMsgType[h.MessageType]
-	if T == nil {
-		return nil, errors.New("No Message configured for this type")
+// DecodeBody returns a new message of the registered type, it is the same
+// pointer type that was registered.
+func (d *ProtobufProtocol) DecodeBody(body []byte, h *protobufPacketHeader) (msg interface{}, err error) {
+	return d.decodeBody(d.getConfig().hasher, body, h)
+}
+
+func (d *ProtobufProtocol) decodeBody(hasher *packetHasher, body []byte, h *protobufPacketHeader) (msg interface{}, err error) {
+	if len(body) != int(h.ContentSize) {
+		return nil, ErrContentSize
 	}
 
-	msg = reflect.New(T.Elem()).Interface().(proto.Message)
-	err = proto.Unmarshal(body, msg)
+	if err := h.ValidateContent(body, hasher); err != nil {
+		return nil, err
+	}
+
+	T, ok := d.typeOf(h.MessageType)
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownID, h.MessageType)
+	}
+
+	msg = reflect.New(T.Elem()).Interface()
+	m, _ := messageV2(msg)
+	err = protoV2.Unmarshal(body, m)
 	if err != nil {
 		return nil, err
 	}
@@ -136,63 +689,289 @@ func (p *ProtobufProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error)
 	codec := &protobufCodec{
 		rw: rw,
 		ProtobufProtocol: p,
-		headBuf: make([]byte, new(protobufPacketHeader).HeaderSize()),
+		config: p.getConfig(),
 	}
+	codec.announced = codec.config.version != ProtobufHeaderName || codec.config.nameTableSize <= 0
 	cc = codec
 	return
 }
 
+// announceSize is the size of the name table announcement still to be sent.
+func (c *protobufCodec) announceSize() int {
+	if c.announced {
+		return 0
+	}
+	return protobufHeaderSizeName
+}
+
+// putAnnouncement fills b of announceSize bytes.
+func (c *protobufCodec) putAnnouncement(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	h := protobufPacketHeader{Version: ProtobufHeaderName, Kind: nameAnnounce, ContentSize: uint32(c.config.nameTableSize)}
+	h.PutBytes(b)
+}
+
+// sendTable returns the names to define for the peer, nil until the peer
+// announced its table size. Receive sets the size, so it is read atomically.
+func (c *protobufCodec) sendTable() *nameTable {
+	size := int(atomic.LoadInt32(&c.peerTableSize))
+	if c.config.nameTableSize < size {
+		size = c.config.nameTableSize
+	}
+	if size <= 0 {
+		return nil
+	}
+	if c.sendNames.ids == nil {
+		c.sendNames.ids = make(map[string]uint16)
+	}
+	c.sendNames.size = size
+	return &c.sendNames
+}
+
 type protobufCodec struct {
-	headBuf []byte
-	bodyBuf []byte
-	rw      io.ReadWriter
+	head   [protobufHeaderSizeV2]byte
+	header protobufPacketHeader
+	batch  *Buffer
+	rw     io.ReadWriter
+	config protobufConfig
+
+	sendNames     nameTable
+	recvNames     []protoreflect.MessageType
+	nameBuf       []byte
+	announced     bool
+	peerTableSize int32
+
 	*ProtobufProtocol
 }
 
 func (c *protobufCodec) Receive() (interface{}, error) {
-	if _, err := io.ReadFull(c.rw, c.headBuf); err != nil {
-		return nil, err
-	}
-	header, err := c.DecodeHeader(c.headBuf)
+	header, err := c.readHeader()
 	if err != nil {
 		return nil, err
-
+	}
+	if header.Version == ProtobufHeaderName {
+		return c.receiveNamed(header)
 	}
 	size := header.ContentSize
 
-	if int(size) > c.maxRecv {
-		return nil, errors.New("Too Large Packet")
+	if uint64(size) > uint64(c.config.maxRecv) {
+		return nil, ErrTooLargePacket
 	}
-	if cap(c.bodyBuf) < int(size) {
-		c.bodyBuf = make([]byte, size, size + 128)
-	}
-	buff := c.bodyBuf[:size]
-	if _, err := io.ReadFull(c.rw, buff); err != nil {
+	buff := c.pool.Get(int(size))
+	defer c.pool.Put(buff)
+	if _, err := io.ReadFull(c.rw, buff.B); err != nil {
 		return nil, err
 	}
 
-	msg, err := c.DecodeBody(buff, header)
+	msg, err := c.decodeBody(c.config.hasher, buff.B, header)
 	return msg, err
 }
 
-func (c *protobufCodec) Send(msg interface{}) error {
-	switch msg.(type) {
-	case proto.Message:
-		all, err := c.EncodeMessage(msg.(proto.Message))
+// readHeader reads the next message header, it takes the name table size
+// the peer announces before.
+func (c *protobufCodec) readHeader() (*protobufPacketHeader, error) {
+	head := c.head[:headerSize(c.config.version)]
+	header := &c.header
+	for {
+		if _, err := io.ReadFull(c.rw, head); err != nil {
+			return nil, err
+		}
+		header.Version = c.config.version
+		if err := header.FromBytes(head); err != nil {
+			return nil, err
+		}
+		if header.Version != ProtobufHeaderName || header.Kind != nameAnnounce {
+			return header, nil
+		}
+		size := header.ContentSize
+		if size > math.MaxUint16+1 {
+			size = math.MaxUint16 + 1
+		}
+		atomic.StoreInt32(&c.peerTableSize, int32(size))
+	}
+}
+
+// readName appends n bytes of the name section to c.nameBuf and returns them.
+func (c *protobufCodec) readName(n int) ([]byte, error) {
+	start := len(c.nameBuf)
+	if cap(c.nameBuf) < start+n {
+		buf := make([]byte, start, 2*cap(c.nameBuf)+n)
+		copy(buf, c.nameBuf)
+		c.nameBuf = buf
+	}
+	c.nameBuf = c.nameBuf[:start+n]
+	_, err := io.ReadFull(c.rw, c.nameBuf[start:])
+	return c.nameBuf[start:], err
+}
+
+func (c *protobufCodec) receiveNamed(header *protobufPacketHeader) (interface{}, error) {
+	c.nameBuf = c.nameBuf[:0]
+	var index uint16
+	if header.Kind == nameRef || header.Kind == nameDefine {
+		b, err := c.readName(2)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		index = binary.BigEndian.Uint16(b)
+	} else if header.Kind != nameInline {
+		return nil, ErrHeaderVersion
+	}
 
-		_, err = c.rw.Write(all)
+	var mt protoreflect.MessageType
+	if header.Kind == nameRef {
+		if int(index) >= len(c.recvNames) {
+			return nil, fmt.Errorf("%w: name %d", ErrUnknownID, index)
+		}
+		mt = c.recvNames[index]
+	} else {
+		b, err := c.readName(2)
+		if err != nil {
+			return nil, err
+		}
+		name, err := c.readName(int(binary.BigEndian.Uint16(b)))
 		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if mt, ok = c.namedType(&c.config, protoreflect.FullName(name)); !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownName, name)
+		}
+		if header.Kind == nameDefine && (int(index) != len(c.recvNames) || int(index) >= c.config.nameTableSize) {
+			return nil, fmt.Errorf("%w: name %d", ErrUnknownID, index)
+		}
+	}
+	header.Name = c.nameBuf
+
+	size := header.ContentSize
+	if uint64(size) > uint64(c.config.maxRecv) {
+		return nil, ErrTooLargePacket
+	}
+	buff := c.pool.Get(int(size))
+	defer c.pool.Put(buff)
+	if _, err := io.ReadFull(c.rw, buff.B); err != nil {
+		return nil, err
+	}
+	if err := header.ValidateContent(buff.B, c.config.hasher); err != nil {
+		return nil, err
+	}
+	if header.Kind == nameDefine {
+		c.recvNames = append(c.recvNames, mt)
+	}
+
+	m := mt.New().Interface()
+	if err := protoV2.Unmarshal(buff.B, m); err != nil {
+		return nil, err
+	}
+	// generated messages come back as their own type, older ones unwrapped
+	return proto.MessageV1(m), nil
+}
+
+func (c *protobufCodec) Send(msg interface{}) error {
+	if c.batch != nil {
+		if err := c.Flush(); err != nil {
 			return err
 		}
+	}
 
+	if pe, ok := msg.(*link.PreEncoded); ok {
+		if pe.Protocol != c.ProtobufProtocol {
+			return link.ErrPreEncodedMismatch
+		}
+		if !c.announced {
+			var head [protobufHeaderSizeName]byte
+			c.putAnnouncement(head[:])
+			if _, err := c.rw.Write(head[:]); err != nil {
+				return err
+			}
+			c.announced = true
+		}
+		_, err := c.rw.Write(pe.Frame)
+		return err
+	}
+
+	m, ok := messageV2(msg)
+	if !ok {
+		return ErrNotMessage
+	}
+	pre := c.announceSize()
+	buf := c.pool.Get(pre + headerSize(c.config.version))
+	defer c.pool.Put(buf)
+	c.putAnnouncement(buf.B[:pre])
+
+	var err error
+	buf.B, _, err = c.encodePacket(&c.config, buf.B, msg, m, c.sendTable())
+	if err != nil {
+		return err
+	}
+	// the announcement and the packet go in one write, a wrapper frames them together
+	if _, err = c.rw.Write(buf.B); err != nil {
+		return err
+	}
+	c.announced = true
+	return nil
+}
+
+func (c *protobufCodec) Enqueue(msg interface{}) error {
+	if c.batch == nil {
+		c.batch = c.pool.Get(0)
+	}
+
+	if pe, ok := msg.(*link.PreEncoded); ok {
+		if pe.Protocol != c.ProtobufProtocol {
+			return link.ErrPreEncodedMismatch
+		}
+		start := len(c.batch.B)
+		c.batch = grow(c.pool, c.batch, c.announceSize())
+		c.batch.B = c.batch.B[:start+c.announceSize()]
+		c.putAnnouncement(c.batch.B[start:])
+		c.batch.B = append(c.batch.B, pe.Frame...)
+		c.announced = true
 		return nil
-	default:
-		return errors.New("Type is not valid")
 	}
 
+	m, ok := messageV2(msg)
+	if !ok {
+		return ErrNotMessage
+	}
+	start, pre := len(c.batch.B), c.announceSize()
+	c.batch = grow(c.pool, c.batch, pre+headerSize(c.config.version))
+	c.batch.B = c.batch.B[:start+pre+headerSize(c.config.version)]
+	c.putAnnouncement(c.batch.B[start : start+pre])
+	var err error
+	c.batch.B, _, err = c.encodePacket(&c.config, c.batch.B, msg, m, c.sendTable())
+	if err != nil {
+		c.batch.B = c.batch.B[:start]
+		return err
+	}
+	c.announced = true
+	return nil
+}
+
+func (c *protobufCodec) Buffered() int {
+	if c.batch == nil {
+		return 0
+	}
+	return len(c.batch.B)
+}
+
+func (c *protobufCodec) Flush() error {
+	if c.batch == nil {
+		return nil
+	}
+	_, err := c.rw.Write(c.batch.B)
+	c.pool.Put(c.batch)
+	c.batch = nil
+	return err
+}
+
+func (c *protobufCodec) Protocol() link.Protocol {
+	return c.ProtobufProtocol
+}
+
+func (c *protobufCodec) Encode(msg interface{}) ([]byte, error) {
+	return c.encodeMessage(&c.config, msg)
 }
 
 func (c *protobufCodec) Close() error {
@@ -3,17 +3,31 @@ package codec
 import (
 	"testing"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
 	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/FTwOoO/link"
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 
+func ProtobufTestProtocol(msgTypes ...reflect.Type) *ProtobufProtocol {
+	protocol, _ := NewProtobufProtocol(msgTypes)
+	return protocol
+}
+
 func compareTestPacket(t *testing.T, msg1 *TestPacket, msg2 *TestPacket) {
 	// Now test and newTest contain the same data.
 	if msg1.Sid != msg2.Sid {
 		t.Fatalf("data mismatch %d != %d", msg1.Sid, msg2.Sid)
 	}
 	if msg1.Mark != msg2.Mark {
-		t.Fatalf("data mismatch %q != %q", msg1.Mark, msg2.Mark)
+		t.Fatalf("data mismatch %v != %v", msg1.Mark, msg2.Mark)
 	}
 
 	if !reflect.DeepEqual(msg1.Sessions, msg2.Sessions) {
@@ -24,7 +38,7 @@ func compareTestPacket(t *testing.T, msg1 *TestPacket, msg2 *TestPacket) {
 
 func TestProtobufCodec(t *testing.T) {
 	var stream bytes.Buffer
-	protocol := NewProtobufProtocol([]reflect.Type{reflect.TypeOf(&TestPacket{})})
+	protocol := ProtobufTestProtocol(reflect.TypeOf(&TestPacket{}))
 
 	codec,  _ := protocol.NewCodec(&stream)
 
@@ -69,3 +83,446 @@ func TestProtobufCodec(t *testing.T) {
 	compareTestPacket(t, sendMsg2, recvMsg2)
 
 }
+
+func TestProtobufPreEncoded(t *testing.T) {
+	var stream bytes.Buffer
+	protocol := ProtobufTestProtocol(reflect.TypeOf(&TestPacket{}))
+	codec, _ := protocol.NewCodec(&stream)
+
+	sendMsg := &TestPacket{
+		Mark:     true,
+		Sid:      7,
+		Sessions: map[string]uint64{"a": 1},
+	}
+	pe, err := link.PreEncode(codec, sendMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = codec.Send(pe); err != nil {
+		t.Fatal(err)
+	}
+
+	recvMsg, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareTestPacket(t, sendMsg, recvMsg.(*TestPacket))
+}
+
+func TestProtobufBatch(t *testing.T) {
+	var stream bytes.Buffer
+	protocol := ProtobufTestProtocol(reflect.TypeOf(&TestPacket{}))
+	codec, _ := protocol.NewCodec(&stream)
+	batch := codec.(link.BatchCodec)
+
+	var sendMsgs []*TestPacket
+	for i := 0; i < 3; i++ {
+		msg := &TestPacket{Sid: uint32(i), Sessions: map[string]uint64{"a": uint64(i)}}
+		sendMsgs = append(sendMsgs, msg)
+		if err := batch.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stream.Len() != 0 {
+		t.Fatal("enqueued messages written before flush")
+	}
+	if err := batch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sendMsg := range sendMsgs {
+		recvMsg, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareTestPacket(t, sendMsg, recvMsg.(*TestPacket))
+	}
+}
+
+func BenchmarkProtobufSend(b *testing.B) {
+	protocol := ProtobufTestProtocol(reflect.TypeOf(&TestPacket{}))
+	codec, _ := protocol.NewCodec(new(benchReadWriter))
+	msg := &TestPacket{Sid: 999, Mark: true}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		codec.Send(msg)
+	}
+}
+
+func BenchmarkProtobufReceive(b *testing.B) {
+	protocol := ProtobufTestProtocol(reflect.TypeOf(&TestPacket{}))
+	var stream bytes.Buffer
+	encoder, _ := protocol.NewCodec(&stream)
+	encoder.Send(&TestPacket{Sid: 999, Mark: true})
+	frame := stream.Bytes()
+
+	rw := new(benchReadWriter)
+	codec, _ := protocol.NewCodec(rw)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rw.Reset(frame)
+		codec.Receive()
+	}
+}
+
+func TestProtobufHash(t *testing.T) {
+	for _, algo := range []HashAlgorithm{HashCRC32C, HashXXH64, HashHMAC} {
+		protocol := ProtobufTestProtocol(reflect.TypeOf(&TestPacket{}))
+		if err := protocol.SetHash(algo, []byte("key")); err != nil {
+			t.Fatal(err)
+		}
+
+		var stream bytes.Buffer
+		codec, _ := protocol.NewCodec(&stream)
+		sendMsg := &TestPacket{Sid: 42, Sessions: map[string]uint64{"a": 1}}
+		codec.Send(sendMsg)
+		if binary.BigEndian.Uint64(stream.Bytes()[4:12]) == 0 {
+			t.Fatalf("hash %d not written", algo)
+		}
+		frame := append([]byte(nil), stream.Bytes()...)
+
+		recvMsg, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareTestPacket(t, sendMsg, recvMsg.(*TestPacket))
+
+		frame[len(frame)-1] ^= 1
+		stream.Write(frame)
+		if _, err := codec.Receive(); err != ErrHashMismatch {
+			t.Fatalf("hash %d corrupted packet accepted: %v", algo, err)
+		}
+	}
+
+	sender := ProtobufTestProtocol(reflect.TypeOf(&TestPacket{}))
+	sender.SetHash(HashHMAC, []byte("forged"))
+	receiver := ProtobufTestProtocol(reflect.TypeOf(&TestPacket{}))
+	receiver.SetHash(HashHMAC, []byte("key"))
+	var stream bytes.Buffer
+	encoder, _ := sender.NewCodec(&stream)
+	decoder, _ := receiver.NewCodec(&stream)
+	encoder.Send(&TestPacket{Sid: 1})
+	if _, err := decoder.Receive(); err != ErrHashMismatch {
+		t.Fatalf("packet with wrong key accepted: %v", err)
+	}
+
+	if err := receiver.SetHash(HashHMAC, nil); err != ErrUnsupportedHash {
+		t.Fatalf("hmac without key accepted: %v", err)
+	}
+}
+
+func TestProtobufRegister(t *testing.T) {
+	protocol := ProtobufTestProtocol()
+	if err := protocol.Register(7, &TestPacket{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.Register(7, &empty.Empty{}); !errors.Is(err, ErrDuplicateID) {
+		t.Fatalf("duplicate id not rejected: %v", err)
+	}
+	if err := protocol.Register(8, &TestPacket{}); !errors.Is(err, ErrDuplicateType) {
+		t.Fatalf("duplicate type not rejected: %v", err)
+	}
+	protocol.Register(9, &empty.Empty{})
+
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+	sendMsg := &TestPacket{Sid: 3}
+	codec.Send(sendMsg)
+	if binary.BigEndian.Uint16(stream.Bytes()) != 7 {
+		t.Fatalf("wire id not match: %d", binary.BigEndian.Uint16(stream.Bytes()))
+	}
+	recvMsg, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareTestPacket(t, sendMsg, recvMsg.(*TestPacket))
+
+	var manifest bytes.Buffer
+	protocol.WriteManifest(&manifest)
+	if manifest.String() != "7 protodef.TestPacket\n9 google.protobuf.Empty\n" {
+		t.Fatalf("manifest not match: %q", manifest.String())
+	}
+
+	loaded := ProtobufTestProtocol()
+	if err := loaded.LoadManifest(strings.NewReader("# deployed\n7 protodef.TestPacket\n\n10 google.protobuf.Empty # moved\n")); err != nil {
+		t.Fatal(err)
+	}
+	err = protocol.CheckCompatible(loaded)
+	if e, ok := err.(*IncompatibleError); !ok || len(e.Conflicts) != 1 || e.Conflicts[0] != "google.protobuf.Empty is id 9 and 10" {
+		t.Fatalf("moved message not found: %v", err)
+	}
+
+	if err := ProtobufTestProtocol().LoadManifest(strings.NewReader("1 no.Such")); !errors.Is(err, ErrUnknownName) {
+		t.Fatalf("unknown message not rejected: %v", err)
+	}
+}
+
+func TestProtobufLarge(t *testing.T) {
+	sendMsg := &TestPacket{Sid: 1, Sessions: map[string]uint64{}}
+	for i := 0; i < 10000; i++ {
+		sendMsg.Sessions[strings.Repeat("k", 8)+strconv.Itoa(i)] = uint64(i)
+	}
+
+	var stream bytes.Buffer
+	v1 := ProtobufTestProtocol(reflect.TypeOf(&TestPacket{}))
+	codec, _ := v1.NewCodec(&stream)
+	if err := codec.Send(sendMsg); err != ErrTooLargePacket {
+		t.Fatalf("large message sent with a 16 bit size: %v", err)
+	}
+	codec.Send(&TestPacket{Sid: 2, Sessions: map[string]uint64{"a": 1}})
+
+	v2 := ProtobufTestProtocol(reflect.TypeOf(&TestPacket{}))
+	if err := v2.SetHeader(ProtobufHeaderV2, 1<<20, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	codec, _ = v2.NewCodec(&stream)
+	if _, err := codec.Receive(); err != ErrHeaderVersion {
+		t.Fatalf("v1 header accepted: %v", err)
+	}
+
+	stream.Reset()
+	if err := codec.Send(sendMsg); err != nil {
+		t.Fatal(err)
+	}
+	if stream.Len() <= 1<<16 {
+		t.Fatalf("message not large: %d", stream.Len())
+	}
+	recvMsg, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareTestPacket(t, sendMsg, recvMsg.(*TestPacket))
+
+	codec.Send(sendMsg)
+	// the limits apply to codecs created afterwards
+	v2.SetHeader(ProtobufHeaderV2, 1<<16, 1<<16)
+	codec, _ = v2.NewCodec(&stream)
+	if _, err := codec.Receive(); err != ErrTooLargePacket {
+		t.Fatalf("large message received over maxRecv: %v", err)
+	}
+	if err := codec.Send(sendMsg); err != ErrTooLargePacket {
+		t.Fatalf("large message sent over maxSend: %v", err)
+	}
+}
+
+func TestProtobufSetDuringUse(t *testing.T) {
+	protocol := ProtobufTestProtocol(reflect.TypeOf(&TestPacket{}))
+	codec, _ := protocol.NewCodec(new(benchReadWriter))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			protocol.SetHash(HashCRC32C, nil)
+			protocol.SetHeader(ProtobufHeaderV2, 1<<20, 1<<20)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := codec.Send(&TestPacket{Sid: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestProtobufErrors(t *testing.T) {
+	if _, err := NewProtobufProtocol([]reflect.Type{reflect.TypeOf(TestPacket{})}); !errors.Is(err, ErrNotMessage) {
+		t.Fatalf("non pointer type accepted: %v", err)
+	}
+	if _, err := NewProtobufProtocol([]reflect.Type{reflect.TypeOf(&MyMessage1{})}); !errors.Is(err, ErrNotMessage) {
+		t.Fatalf("non protobuf type accepted: %v", err)
+	}
+
+	protocol := ProtobufTestProtocol(reflect.TypeOf(&TestPacket{}))
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+	if err := codec.Send(&wrapperspb.StringValue{Value: "x"}); !errors.Is(err, ErrUnknownType) {
+		t.Fatalf("unregistered message sent: %v", err)
+	}
+	if err := codec.Send("x"); !errors.Is(err, ErrNotMessage) {
+		t.Fatalf("string sent: %v", err)
+	}
+	if stream.Len() != 0 {
+		t.Fatal("failed send wrote")
+	}
+
+	// the receiver learns the type after the codec was created
+	receiver := ProtobufTestProtocol()
+	decoder, _ := receiver.NewCodec(&stream)
+	codec.Send(&TestPacket{Sid: 1})
+	if _, err := decoder.Receive(); !errors.Is(err, ErrUnknownID) {
+		t.Fatalf("unknown id received: %v", err)
+	}
+	receiver.Register(0, &TestPacket{})
+	codec.Send(&TestPacket{Sid: 2})
+	if msg, err := decoder.Receive(); err != nil || msg.(*TestPacket).Sid != 2 {
+		t.Fatalf("registered message not received: %v, %v", msg, err)
+	}
+}
+
+func TestProtobufV2(t *testing.T) {
+	protocol := ProtobufTestProtocol()
+	if err := protocol.Register(1, &wrapperspb.StringValue{}); err != nil {
+		t.Fatal(err)
+	}
+	protocol.Register(2, &TestPacket{})
+
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+	codec.Send(&wrapperspb.StringValue{Value: "v2"})
+	codec.Send(&TestPacket{Sid: 1})
+
+	msg, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := msg.(*wrapperspb.StringValue); !ok || v.Value != "v2" {
+		t.Fatalf("v2 message not match: %v", msg)
+	}
+	if msg, err = codec.Receive(); err != nil || msg.(*TestPacket).Sid != 1 {
+		t.Fatalf("v1 message not match: %v, %v", msg, err)
+	}
+}
+
+func namedTestProtocol(tableSize int) *ProtobufProtocol {
+	protocol := ProtobufTestProtocol(reflect.TypeOf(&TestPacket{}))
+	protocol.SetHeader(ProtobufHeaderName, 1<<16, 1<<16)
+	protocol.SetHash(HashCRC32C, nil)
+	protocol.SetNameTable(tableSize)
+	return protocol
+}
+
+func TestProtobufNamed(t *testing.T) {
+	// the table is only used when both sides set one
+	for _, tables := range [][2]int{{0, 16}, {16, 0}, {16, 16}} {
+		protocol1, protocol2 := namedTestProtocol(tables[0]), namedTestProtocol(tables[1])
+		protocol2.SetNamePackages("google.protobuf")
+
+		var stream, reply bytes.Buffer
+		codec1, _ := protocol1.NewCodec(&testConn{&reply, &stream})
+		codec2, _ := protocol2.NewCodec(&testConn{&stream, &reply})
+
+		// codec1 sends names inline until the first message of codec2 announced its table
+		if err := codec2.Send(&TestPacket{Sid: 100}); err != nil {
+			t.Fatal(err)
+		}
+		if msg, err := codec1.Receive(); err != nil || msg.(*TestPacket).Sid != 100 {
+			t.Fatalf("reply not match: %v, %v", msg, err)
+		}
+
+		var sizes []int
+		for i := 0; i < 3; i++ {
+			before := stream.Len()
+			if err := codec1.Send(&TestPacket{Sid: uint32(i + 1)}); err != nil {
+				t.Fatal(err)
+			}
+			sizes = append(sizes, stream.Len()-before)
+		}
+		codec1.Send(&wrapperspb.StringValue{Value: "named"})
+
+		interned := tables[0] > 0 && tables[1] > 0
+		if !interned && sizes[2] != sizes[1] {
+			t.Fatalf("inline names differ in size: %v", sizes)
+		}
+		if interned && sizes[1] >= sizes[0] {
+			t.Fatalf("interned name not smaller: %v", sizes)
+		}
+
+		for i := 0; i < 3; i++ {
+			msg, err := codec2.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.(*TestPacket).Sid != uint32(i+1) {
+				t.Fatalf("message not match: %v", msg)
+			}
+		}
+		msg, err := codec2.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, ok := msg.(*wrapperspb.StringValue); !ok || v.Value != "named" {
+			t.Fatalf("v2 message not match: %v", msg)
+		}
+	}
+}
+
+func TestProtobufNamedErrors(t *testing.T) {
+	protocol := namedTestProtocol(0)
+	var stream bytes.Buffer
+	_, codec, err := handshakePair(t, protocol, protocol, &stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a linked message that is neither registered nor in an allowed package
+	for _, name := range []string{"link.codec.Missing", "google.protobuf.Int32Value"} {
+		stream.Write([]byte{ProtobufHeaderName, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+		stream.Write(binary.BigEndian.AppendUint16(nil, uint16(len(name))))
+		stream.WriteString(name)
+		if _, err := codec.Receive(); !errors.Is(err, ErrUnknownName) {
+			t.Fatalf("name %s: %v", name, err)
+		}
+	}
+
+	stream.Write([]byte{ProtobufHeaderName, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5})
+	if _, err := codec.Receive(); !errors.Is(err, ErrUnknownID) {
+		t.Fatalf("undefined name index: %v", err)
+	}
+
+	// no table was negotiated, so a define is rejected
+	name := "protodef.TestPacket"
+	stream.Write([]byte{ProtobufHeaderName, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	stream.Write(binary.BigEndian.AppendUint16(nil, uint16(len(name))))
+	stream.WriteString(name)
+	if _, err := codec.Receive(); !errors.Is(err, ErrUnknownID) {
+		t.Fatalf("name defined past the table: %v", err)
+	}
+}
+
+// the name mode writes nothing before the first message, so the wrappers carry it
+func TestProtobufNamedWrapped(t *testing.T) {
+	named := namedTestProtocol(16)
+	fixlen, _ := FixLen(named, 4, binary.BigEndian, 1<<16, 1<<16)
+	secure, _ := Secure(named, SecureConfig{Cipher: SecureChaCha20Poly1305})
+	for _, protocol := range []link.Protocol{named, fixlen, Bufio(named, 1024, 1024), secure} {
+		conn1, conn2 := net.Pipe()
+		done := make(chan link.Codec)
+		go func() {
+			codec, err := protocol.NewCodec(conn2)
+			if err != nil {
+				t.Error(err)
+			}
+			done <- codec
+		}()
+		codec1, err := protocol.NewCodec(conn1)
+		codec2 := <-done
+		if err != nil || codec2 == nil {
+			t.Fatalf("%T: %v", protocol, err)
+		}
+
+		go func() {
+			if err := codec2.Send(&TestPacket{Sid: 100}); err != nil {
+				t.Error(err)
+			}
+		}()
+		if msg, err := codec1.Receive(); err != nil || msg.(*TestPacket).Sid != 100 {
+			t.Fatalf("%T: reply not match: %v, %v", protocol, msg, err)
+		}
+		go func() {
+			for i := 1; i <= 3; i++ {
+				if err := codec1.Send(&TestPacket{Sid: uint32(i)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		for i := 1; i <= 3; i++ {
+			msg, err := codec2.Receive()
+			if err != nil || msg.(*TestPacket).Sid != uint32(i) {
+				t.Fatalf("%T: message not match: %v, %v", protocol, msg, err)
+			}
+		}
+		codec1.Close()
+		codec2.Close()
+	}
+}
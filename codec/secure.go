@@ -0,0 +1,412 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/FTwOoO/link"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrSecureConfig    = errors.New("Invalid Secure Config")
+	ErrSecureHandshake = errors.New("Secure Handshake Failed")
+	ErrDecrypt         = errors.New("Frame Authentication Failed")
+	ErrReplay          = errors.New("Replayed Frame")
+)
+
+// SecureCipher is the AEAD records are sealed with.
+type SecureCipher byte
+
+const (
+	SecureChaCha20Poly1305 SecureCipher = iota
+	// SecureAESGCM is AES-256-GCM, faster than ChaCha20-Poly1305 with AES instructions.
+	SecureAESGCM
+)
+
+const (
+	secureVersion   = 1
+	secureHelloSize = 2 + 32
+	// a record is the ciphertext length, the sequence number and the record type
+	secureHeaderSize = 4 + 8 + 1
+	// secureRecordSize is the most plaintext in a record, longer sends are split
+	secureRecordSize = 1 << 16
+	secureKeySize    = 32
+)
+
+// record types
+const (
+	secureData byte = iota
+	// secureRekey is empty, the sender uses the next key after it
+	secureRekey
+)
+
+type SecureConfig struct {
+	Cipher SecureCipher
+	// PSK is mixed into the keys when set. The key exchange alone only keeps
+	// passive listeners out, with a PSK a man in the middle fails on the first
+	// record with ErrDecrypt.
+	PSK []byte
+	// RekeyFrames and RekeyInterval make the sender move to the next key after
+	// that many records or that much time, 0 means never.
+	RekeyFrames   uint64
+	RekeyInterval time.Duration
+	// HandshakeTimeout limits the key exchange, DefaultHandshakeTimeout when 0.
+	HandshakeTimeout time.Duration
+}
+
+type SecureProtocol struct {
+	base   link.Protocol
+	config SecureConfig
+	pool   BufferPool
+}
+
+// Secure wraps the stream of base like Bufio. NewCodec exchanges X25519 keys
+// on the connection, then every Send is sealed into records with a counter
+// nonce, so a replayed, dropped or reordered record fails with ErrReplay.
+func Secure(base link.Protocol, config SecureConfig) (*SecureProtocol, error) {
+	if config.Cipher > SecureAESGCM {
+		return nil, ErrSecureConfig
+	}
+	return &SecureProtocol{
+		base:   base,
+		config: config,
+		pool:   DefaultPool,
+	}, nil
+}
+
+func (p *SecureProtocol) SetPool(pool BufferPool) {
+	p.pool = pool
+}
+
+func (p *SecureProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	codec := &secureCodec{
+		p:  p,
+		rw: rw,
+	}
+	codec.stream.c = codec
+	if err = codec.handshake(); err != nil {
+		return
+	}
+
+	// a base that handshakes in NewCodec has its writes sealed and sent right away
+	codec.stream.direct = true
+	codec.base, err = p.base.NewCodec(&codec.stream)
+	codec.stream.direct = false
+	if err != nil {
+		return
+	}
+	cc = codec
+	return
+}
+
+func (p *SecureProtocol) newAEAD(key []byte) (cipher.AEAD, error) {
+	if p.config.Cipher == SecureAESGCM {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return chacha20poly1305.New(key)
+}
+
+// secureKeys is the key and sequence number of one direction.
+type secureKeys struct {
+	key    []byte
+	aead   cipher.AEAD
+	seq    uint64
+	frames uint64
+	nonce  [12]byte
+}
+
+func (k *secureKeys) setKey(p *SecureProtocol, key []byte) (err error) {
+	k.key = key
+	k.frames = 0
+	k.aead, err = p.newAEAD(key)
+	return
+}
+
+// rekey moves to the key derived from the current one, the old key is gone.
+func (k *secureKeys) rekey(p *SecureProtocol) error {
+	next := make([]byte, secureKeySize)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, k.key, []byte("link secure rekey")), next); err != nil {
+		return err
+	}
+	return k.setKey(p, next)
+}
+
+// nonceFor is 4 zero bytes and the sequence number, each direction has its own keys.
+func (k *secureKeys) nonceFor(seq uint64) []byte {
+	binary.BigEndian.PutUint64(k.nonce[4:], seq)
+	return k.nonce[:]
+}
+
+type secureCodec struct {
+	p        *SecureProtocol
+	base     link.Codec
+	rw       io.ReadWriter
+	stream   secureStream
+	send     secureKeys
+	recv     secureKeys
+	head     [secureHeaderSize]byte
+	sendHead [secureHeaderSize]byte
+	// sealed is where Send builds the records
+	sealed  *Buffer
+	rekeyAt time.Time
+}
+
+// handshake sends the version, the cipher and an ephemeral X25519 public key
+// and derives a key per direction from the shared secret and the PSK.
+func (c *secureCodec) handshake() error {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	hello := make([]byte, 0, secureHelloSize)
+	hello = append(hello, secureVersion, byte(c.p.config.Cipher))
+	hello = append(hello, private.PublicKey().Bytes()...)
+
+	var peer [secureHelloSize]byte
+	err = exchange(c.rw, hello, c.p.config.HandshakeTimeout, func(r io.Reader) error {
+		_, err := io.ReadFull(r, peer[:])
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if peer[0] != secureVersion || peer[1] != hello[1] {
+		return ErrSecureHandshake
+	}
+
+	ownKey, peerKey := hello[2:], peer[2:]
+	public, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return ErrSecureHandshake
+	}
+	secret, err := private.ECDH(public)
+	if err != nil {
+		return ErrSecureHandshake
+	}
+
+	// both sides order the public keys the same way, the lower one sends with the first key
+	order := bytes.Compare(ownKey, peerKey)
+	if order == 0 {
+		return ErrSecureHandshake
+	}
+	low, high := ownKey, peerKey
+	if order > 0 {
+		low, high = peerKey, ownKey
+	}
+	info := append(append([]byte("link secure v1"), low...), high...)
+	keys := make([]byte, 2*secureKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, c.p.config.PSK, info), keys); err != nil {
+		return err
+	}
+	sendKey, recvKey := keys[:secureKeySize], keys[secureKeySize:]
+	if order > 0 {
+		sendKey, recvKey = recvKey, sendKey
+	}
+	if err := c.send.setKey(c.p, sendKey); err != nil {
+		return err
+	}
+	c.rekeyAt = time.Now()
+	return c.recv.setKey(c.p, recvKey)
+}
+
+// seal appends a record of plain to c.sealed.
+func (c *secureCodec) seal(kind byte, plain []byte) {
+	c.sealed = grow(c.p.pool, c.sealed, secureHeaderSize+len(plain)+c.send.aead.Overhead())
+	head := c.sendHead[:]
+	binary.BigEndian.PutUint32(head, uint32(len(plain)+c.send.aead.Overhead()))
+	binary.BigEndian.PutUint64(head[4:], c.send.seq)
+	head[12] = kind
+	c.sealed.B = c.send.aead.Seal(append(c.sealed.B, head...), c.send.nonceFor(c.send.seq), plain, head)
+	c.send.seq++
+	c.send.frames++
+}
+
+func (c *secureCodec) rekeyDue() bool {
+	config := &c.p.config
+	return (config.RekeyFrames > 0 && c.send.frames >= config.RekeyFrames) ||
+		(config.RekeyInterval > 0 && time.Since(c.rekeyAt) >= config.RekeyInterval)
+}
+
+func (c *secureCodec) Send(msg interface{}) error {
+	c.stream.out = c.p.pool.Get(0)
+	defer func() {
+		c.p.pool.Put(c.stream.out)
+		c.stream.out = nil
+	}()
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+	return c.write(c.stream.out.B)
+}
+
+// write seals plain into records and writes them at once.
+func (c *secureCodec) write(plain []byte) error {
+	c.sealed = c.p.pool.Get(0)
+	defer func() {
+		c.p.pool.Put(c.sealed)
+		c.sealed = nil
+	}()
+	for len(plain) > 0 {
+		if c.rekeyDue() {
+			c.seal(secureRekey, nil)
+			if err := c.send.rekey(c.p); err != nil {
+				return err
+			}
+			c.rekeyAt = time.Now()
+		}
+		n := len(plain)
+		if n > secureRecordSize {
+			n = secureRecordSize
+		}
+		c.seal(secureData, plain[:n])
+		plain = plain[n:]
+	}
+	_, err := c.rw.Write(c.sealed.B)
+	return err
+}
+
+// open reads the next record and returns its plaintext, valid until the next call.
+func (c *secureCodec) open() ([]byte, error) {
+	for {
+		if _, err := io.ReadFull(c.rw, c.head[:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(c.head[:])
+		seq := binary.BigEndian.Uint64(c.head[4:])
+		if seq != c.recv.seq {
+			return nil, ErrReplay
+		}
+		if size < uint32(c.recv.aead.Overhead()) {
+			return nil, ErrInvalidLength
+		}
+		if size > uint32(secureRecordSize+c.recv.aead.Overhead()) {
+			return nil, ErrTooLargePacket
+		}
+
+		if cap(c.stream.in) < int(size) {
+			c.stream.in = make([]byte, size)
+		}
+		record := c.stream.in[:size]
+		if _, err := io.ReadFull(c.rw, record); err != nil {
+			return nil, err
+		}
+		plain, err := c.recv.aead.Open(record[:0], c.recv.nonceFor(seq), record, c.head[:])
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		c.recv.seq++
+
+		switch c.head[12] {
+		case secureData:
+			if len(plain) > 0 {
+				return plain, nil
+			}
+		case secureRekey:
+			if err := c.recv.rekey(c.p); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrDecrypt
+		}
+	}
+}
+
+func (c *secureCodec) Receive() (interface{}, error) {
+	return c.base.Receive()
+}
+
+// ReadBuffered counts the opened bytes the base codec has not read and what it buffered from them.
+func (c *secureCodec) ReadBuffered() int {
+	n := len(c.stream.plain)
+	if base, ok := c.base.(link.ReadBufferedCodec); ok {
+		n += base.ReadBuffered()
+	}
+	return n
+}
+
+func (c *secureCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// secureStream is what the base codec reads from and writes to. A Send of
+// the base is collected in out and sealed at once, Read opens records as
+// the base needs them.
+type secureStream struct {
+	c     *secureCodec
+	out   *Buffer
+	in    []byte
+	plain []byte
+	err   error
+	// direct is set while the base codec is created, its writes go out at once
+	direct bool
+}
+
+func (s *secureStream) Read(p []byte) (int, error) {
+	if len(s.plain) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		// the stream is broken after a bad record
+		if s.plain, s.err = s.c.open(); s.err != nil {
+			return 0, s.err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *secureStream) Write(p []byte) (int, error) {
+	if s.direct {
+		if err := s.c.write(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if s.out == nil {
+		return 0, io.ErrClosedPipe
+	}
+	s.out = grow(s.c.p.pool, s.out, len(p))
+	s.out.B = append(s.out.B, p...)
+	return len(p), nil
+}
+
+// Flush, SetDeadline and Close reach the connection while the base codec is
+// created, so its handshake is flushed and limited in time.
+func (s *secureStream) Flush() error {
+	if f, ok := s.c.rw.(flusher); ok && s.direct {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (s *secureStream) SetDeadline(t time.Time) error {
+	if d, ok := s.c.rw.(deadlineSetter); ok && s.direct {
+		return d.SetDeadline(t)
+	}
+	return errNoDeadline
+}
+
+func (s *secureStream) Close() error {
+	if c, ok := s.c.rw.(io.Closer); ok && s.direct {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FTwOoO/link"
+)
+
+// testConn is one end of a pair of pipes, its reader and writer can be swapped after the handshake.
+type testConn struct {
+	r io.Reader
+	w io.Writer
+}
+
+func (c *testConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *testConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// Close ends the pipes, a handshake without a deadline is stopped by closing.
+func (c *testConn) Close() error {
+	if r, ok := c.r.(io.Closer); ok {
+		r.Close()
+	}
+	if w, ok := c.w.(io.Closer); ok {
+		w.Close()
+	}
+	return nil
+}
+
+// handshakePair creates the codecs of both ends, after the handshake codec1
+// writes to stream and codec2 reads from it.
+func handshakePair(t *testing.T, p1, p2 link.Protocol, stream *bytes.Buffer) (link.Codec, link.Codec, error) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	conn1, conn2 := &testConn{r2, w1}, &testConn{r1, w2}
+
+	type result struct {
+		codec link.Codec
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		codec, err := p2.NewCodec(conn2)
+		done <- result{codec, err}
+	}()
+	codec1, err := p1.NewCodec(conn1)
+	r := <-done
+	if err == nil {
+		err = r.err
+	}
+	conn1.w, conn2.r = stream, stream
+	return codec1, r.codec, err
+}
+
+func Test_Secure(t *testing.T) {
+	for _, cipher := range []SecureCipher{SecureChaCha20Poly1305, SecureAESGCM} {
+		for _, base := range []link.Protocol{JsonTestProtocol(), FixLenTestProtocol(t, 1024), Bufio(JsonTestProtocol(), 1024, 1024)} {
+			protocol, _ := Secure(base, SecureConfig{Cipher: cipher})
+			var stream bytes.Buffer
+			codec1, codec2, err := handshakePair(t, protocol, protocol, &stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sendMsg := MyMessage1{Field1: "abc", Field2: 123}
+			for i := 0; i < 3; i++ {
+				if err := codec1.Send(&sendMsg); err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(stream.Bytes(), []byte("abc")) {
+					t.Fatal("message not encrypted")
+				}
+				msg, err := codec2.Receive()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if *msg.(*MyMessage1) != sendMsg {
+					t.Fatalf("message not match: %v", msg)
+				}
+			}
+		}
+	}
+}
+
+func Test_SecureProtobuf(t *testing.T) {
+	protocol, _ := Secure(ProtobufTestProtocol(reflect.TypeOf(&TestPacket{})), SecureConfig{PSK: []byte("psk")})
+	var stream bytes.Buffer
+	codec1, codec2, err := handshakePair(t, protocol, protocol, &stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMsg := &TestPacket{Sid: 999, Sessions: map[string]uint64{"a": 1}}
+	codec1.Send(sendMsg)
+	msg, err := codec2.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareTestPacket(t, sendMsg, msg.(*TestPacket))
+}
+
+func Test_SecureRekey(t *testing.T) {
+	protocol, _ := Secure(JsonTestProtocol(), SecureConfig{RekeyFrames: 2})
+	var stream bytes.Buffer
+	codec1, codec2, err := handshakePair(t, protocol, protocol, &stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a long message is split into records and rekeyed in between
+	long := strings.Repeat("x", 3*secureRecordSize)
+	for _, field := range []string{"a", long, "b", "c", "d"} {
+		if err := codec1.Send(&MyMessage1{Field1: field}); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := codec2.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.(*MyMessage1).Field1 != field {
+			t.Fatal("message not match")
+		}
+	}
+	if key := codec1.(*secureCodec).send.key; !bytes.Equal(key, codec2.(*secureCodec).recv.key) {
+		t.Fatal("keys not moved together")
+	}
+}
+
+func Test_SecureReject(t *testing.T) {
+	protocol, _ := Secure(JsonTestProtocol(), SecureConfig{})
+	var stream bytes.Buffer
+	codec1, codec2, _ := handshakePair(t, protocol, protocol, &stream)
+	codec1.Send(&MyMessage1{Field1: "abc"})
+	record := append([]byte{}, stream.Bytes()...)
+	if _, err := codec2.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	stream.Write(record)
+	if _, err := codec2.Receive(); err != ErrReplay {
+		t.Fatalf("replayed record not rejected: %v", err)
+	}
+
+	stream.Reset()
+	codec1, codec2, _ = handshakePair(t, protocol, protocol, &stream)
+	codec1.Send(&MyMessage1{Field1: "abc"})
+	stream.Bytes()[secureHeaderSize] ^= 1
+	if _, err := codec2.Receive(); err != ErrDecrypt {
+		t.Fatalf("changed record not rejected: %v", err)
+	}
+
+	other, _ := Secure(JsonTestProtocol(), SecureConfig{PSK: []byte("other")})
+	stream.Reset()
+	codec1, codec2, _ = handshakePair(t, protocol, other, &stream)
+	codec1.Send(&MyMessage1{Field1: "abc"})
+	if _, err := codec2.Receive(); err != ErrDecrypt {
+		t.Fatalf("record of another PSK not rejected: %v", err)
+	}
+
+	aes, _ := Secure(JsonTestProtocol(), SecureConfig{Cipher: SecureAESGCM})
+	if _, _, err := handshakePair(t, protocol, aes, &stream); err != ErrSecureHandshake {
+		t.Fatalf("cipher mismatch not rejected: %v", err)
+	}
+}
+
+func Test_SecureHandshakeTimeout(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	defer conn2.Close()
+
+	// the peer never answers
+	protocol, _ := Secure(JsonTestProtocol(), SecureConfig{HandshakeTimeout: 50 * time.Millisecond})
+	_, err := protocol.NewCodec(conn1)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("silent peer not timed out: %v", err)
+	}
+}
+
+// a base that handshakes in NewCodec, or with its first message, works through Secure
+func Test_SecureNegotiatingBase(t *testing.T) {
+	compress, _ := Compress(JsonTestProtocol(), CompressGzip, 0)
+	compress.SetNegotiate(CompressSnappy, CompressGzip)
+	compress.SetHandshakeTimeout(time.Second)
+	json := &MyMessage1{"abc", 123}
+	named := &TestPacket{Sid: 7}
+
+	cases := []struct {
+		base link.Protocol
+		msg  interface{}
+	}{
+		{compress, json},
+		{Bufio(compress, 1024, 1024), json},
+		{namedTestProtocol(16), named},
+	}
+	for _, c := range cases {
+		secure, _ := Secure(c.base, SecureConfig{HandshakeTimeout: time.Second})
+		for _, protocol := range []link.Protocol{secure, Bufio(secure, 1024, 1024)} {
+			conn1, conn2 := net.Pipe()
+			done := make(chan link.Codec)
+			go func() {
+				codec, err := protocol.NewCodec(conn2)
+				if err != nil {
+					t.Error(err)
+				}
+				done <- codec
+			}()
+			codec1, err := protocol.NewCodec(conn1)
+			codec2 := <-done
+			if err != nil || codec2 == nil {
+				t.Fatalf("%T over %T: %v", protocol, c.base, err)
+			}
+
+			for _, pair := range [][2]link.Codec{{codec1, codec2}, {codec2, codec1}} {
+				go func(sender link.Codec) {
+					if err := sender.Send(c.msg); err != nil {
+						t.Error(err)
+					}
+				}(pair[0])
+				msg, err := pair[1].Receive()
+				if err != nil {
+					t.Fatalf("%T over %T: %v", protocol, c.base, err)
+				}
+				if reflect.TypeOf(msg) != reflect.TypeOf(c.msg) {
+					t.Fatalf("message not match: %v", msg)
+				}
+			}
+			codec1.Close()
+			codec2.Close()
+		}
+	}
+}
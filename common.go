@@ -24,5 +24,16 @@ import (
 var (
 	ErrNoSession = errors.New("session in pool but can't pick one.")
 	ErrSessionNotFound = errors.New("session not found.")
+	ErrResumeRejected = errors.New("session resume rejected.")
+	ErrNotEncoder = errors.New("codec can't pre-encode messages.")
+	ErrPreEncodedMismatch = errors.New("message was pre-encoded by another protocol.")
+	ErrInvalidPriority = errors.New("invalid send priority.")
+	ErrRateLimited = errors.New("session rate limited.")
+	ErrInvalidHandler = errors.New("handler must be func(*Session, T) error.")
+	ErrNotRegistered = errors.New("message type not registered in protocol.")
+	ErrDuplicateRoute = errors.New("message type already has a handler.")
+	ErrNoRoute = errors.New("no handler for message type.")
+	ErrInvalidPool = errors.New("worker pool needs a worker and a queue size of 0 or more.")
+	ErrDispatcherStopped = errors.New("dispatcher stopped.")
 )
 
@@ -26,38 +26,71 @@ var (
 	UPDATE_INTERVAL time.Duration = 10
 )
 
+// SpeedCounter measures events per second over windows of UPDATE_INTERVAL.
+// Windows are closed lazily by Add and Current, so a counter owns no goroutine.
 type SpeedCounter struct {
 	cnt      uint32
 	Speed    uint32
 	All      uint64
+	start    int64
 	isClosed chan interface{}
 }
 
 func NewSpeedCounter() (sc *SpeedCounter) {
-	sc = &SpeedCounter{isClosed:make(chan interface{}, 1)}
-	go sc.Update()
-	return sc
+	return &SpeedCounter{
+		start:    time.Now().UnixNano(),
+		isClosed: make(chan interface{}, 1),
+	}
 }
 
+// Close stops Update.
 func (sc *SpeedCounter) Close() error {
-	sc.isClosed <- 1
+	select {
+	case sc.isClosed <- 1:
+	default:
+	}
 	return nil
 }
 
+// Update closes a window every UPDATE_INTERVAL until Close, it is only
+// needed when the counter is read through Speed without calling Current.
 func (sc *SpeedCounter) Update() {
-	hsHeartbeat := time.Tick(UPDATE_INTERVAL * time.Second)
+	hsHeartbeat := time.NewTicker(UPDATE_INTERVAL * time.Second)
+	defer hsHeartbeat.Stop()
 	for {
 		select {
-		case <-hsHeartbeat:
+		case <-hsHeartbeat.C:
+			atomic.StoreInt64(&sc.start, time.Now().UnixNano())
 			c := atomic.SwapUint32(&sc.cnt, 0)
-			sc.Speed = c / uint32(UPDATE_INTERVAL)
-			sc.All += uint64(c)
+			atomic.StoreUint32(&sc.Speed, c/uint32(UPDATE_INTERVAL))
+			atomic.AddUint64(&sc.All, uint64(c))
 		case <-sc.isClosed:
 			return
 		}
 	}
 }
 
+// rollWindow closes the current window once UPDATE_INTERVAL has passed, an
+// idle gap of several intervals is averaged into the window.
+func (sc *SpeedCounter) rollWindow() {
+	start := atomic.LoadInt64(&sc.start)
+	now := time.Now().UnixNano()
+	elapsed := time.Duration(now - start)
+	if elapsed < UPDATE_INTERVAL*time.Second || !atomic.CompareAndSwapInt64(&sc.start, start, now) {
+		return
+	}
+	c := atomic.SwapUint32(&sc.cnt, 0)
+	atomic.StoreUint32(&sc.Speed, uint32(float64(c)/elapsed.Seconds()))
+	atomic.AddUint64(&sc.All, uint64(c))
+}
+
 func (sc *SpeedCounter) Add(s uint32) uint32 {
+	sc.rollWindow()
 	return atomic.AddUint32(&sc.cnt, s)
 }
+
+// Current returns the speed of the last closed window.
+func (sc *SpeedCounter) Current() uint32 {
+	sc.rollWindow()
+	return atomic.LoadUint32(&sc.Speed)
+}
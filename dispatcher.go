@@ -0,0 +1,161 @@
+package link
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+// Dispatcher runs tasks of the same key in the order they were dispatched and
+// tasks of different keys in parallel on a fixed pool of workers.
+type Dispatcher struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	queues  map[interface{}]*keyQueue
+	ready   []*keyQueue
+	depth   int
+	stopped bool
+	workers sync.WaitGroup
+	hook    ErrorHook
+}
+
+// keyQueue is in ready or on a worker while it has tasks, never both,
+// so the tasks of a key never run at the same time. It stays in queues
+// while it has tasks or Dispatch calls waiting for space.
+type keyQueue struct {
+	key     interface{}
+	tasks   []func()
+	space   *sync.Cond
+	waiters int
+}
+
+// NewDispatcher starts workers goroutines, Dispatch blocks while a key has
+// depth tasks waiting, 0 means no limit.
+func NewDispatcher(workers, depth int) *Dispatcher {
+	d := &Dispatcher{
+		queues: make(map[interface{}]*keyQueue),
+		depth:  depth,
+	}
+	d.cond = sync.NewCond(&d.mutex)
+	d.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// SetErrorHook sets the hook told about recovered task panics, the session is
+// the key when the key is a *Session. It must be called before Dispatch.
+func (d *Dispatcher) SetErrorHook(hook ErrorHook) {
+	d.hook = hook
+}
+
+// Dispatch queues task behind the other tasks of key.
+func (d *Dispatcher) Dispatch(key interface{}, task func()) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var q *keyQueue
+	for {
+		if d.stopped {
+			return ErrDispatcherStopped
+		}
+		q = d.queues[key]
+		if q == nil {
+			q = &keyQueue{key: key, space: sync.NewCond(&d.mutex)}
+			d.queues[key] = q
+		}
+		if d.depth <= 0 || len(q.tasks) < d.depth {
+			break
+		}
+		q.waiters++
+		q.space.Wait()
+		q.waiters--
+	}
+
+	q.tasks = append(q.tasks, task)
+	if len(q.tasks) == 1 {
+		d.ready = append(d.ready, q)
+		d.cond.Signal()
+	}
+	return nil
+}
+
+func (d *Dispatcher) work() {
+	defer d.workers.Done()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for {
+		for len(d.ready) == 0 && !d.stopped {
+			d.cond.Wait()
+		}
+		if len(d.ready) == 0 {
+			return
+		}
+		q := d.ready[0]
+		d.ready[0] = nil
+		d.ready = d.ready[1:]
+
+		task := q.tasks[0]
+		d.mutex.Unlock()
+		d.run(q.key, task)
+		d.mutex.Lock()
+
+		// the task stays in the queue while it runs, so Dispatch doesn't
+		// make the queue ready a second time
+		q.tasks[0] = nil
+		q.tasks = q.tasks[1:]
+		q.space.Signal()
+		if len(q.tasks) > 0 {
+			// one task per turn, a busy key doesn't starve the others
+			d.ready = append(d.ready, q)
+		} else if q.waiters == 0 {
+			delete(d.queues, q.key)
+		}
+	}
+}
+
+// run recovers a panicking task, the worker and the queue of key go on.
+func (d *Dispatcher) run(key interface{}, task func()) {
+	defer func() {
+		if v := recover(); v != nil && d.hook != nil {
+			session, _ := key.(*Session)
+			d.hook(session, &PanicError{v, debug.Stack()})
+		}
+	}()
+	task()
+}
+
+// Handler returns a Handler that receives from each session and runs handler
+// on the pool in order per session. Receive waits while the session has depth
+// messages queued, so a busy session is slowed down by TCP back pressure.
+func (d *Dispatcher) Handler(handler MessageHandler) Handler {
+	return HandlerFunc(func(session *Session) {
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				session.Close()
+				return
+			}
+			err = d.Dispatch(session, func() {
+				handleMessage(handler, session, msg, d.hook)
+			})
+			if err != nil {
+				session.Close()
+				return
+			}
+		}
+	})
+}
+
+// Stop waits for the queued tasks to run, blocked and later Dispatch calls fail with ErrDispatcherStopped.
+func (d *Dispatcher) Stop() {
+	d.mutex.Lock()
+	d.stopped = true
+	d.cond.Broadcast()
+	for _, q := range d.queues {
+		q.space.Broadcast()
+	}
+	d.mutex.Unlock()
+	d.workers.Wait()
+}
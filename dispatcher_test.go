@@ -0,0 +1,176 @@
+package link
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_DispatcherOrder(t *testing.T) {
+	d := NewDispatcher(4, 8)
+
+	var mutex sync.Mutex
+	got := make(map[int][]int)
+	var running, maxRunning int32
+
+	var wg sync.WaitGroup
+	for key := 0; key < 8; key++ {
+		wg.Add(1)
+		go func(key int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				i := i
+				err := d.Dispatch(key, func() {
+					n := atomic.AddInt32(&running, 1)
+					for {
+						max := atomic.LoadInt32(&maxRunning)
+						if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+							break
+						}
+					}
+					mutex.Lock()
+					got[key] = append(got[key], i)
+					mutex.Unlock()
+					time.Sleep(10 * time.Microsecond)
+					atomic.AddInt32(&running, -1)
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(key)
+	}
+	wg.Wait()
+	d.Stop()
+
+	for key, seq := range got {
+		if len(seq) != 100 {
+			t.Fatalf("key %d ran %d tasks", key, len(seq))
+		}
+		for i, v := range seq {
+			if v != i {
+				t.Fatalf("key %d out of order: %v", key, seq)
+			}
+		}
+	}
+	if maxRunning < 2 || maxRunning > 4 {
+		t.Fatalf("keys not run in parallel on the pool: %d", maxRunning)
+	}
+	if err := d.Dispatch(0, func() {}); err != ErrDispatcherStopped {
+		t.Fatalf("dispatch after stop: %v", err)
+	}
+}
+
+func Test_DispatcherDepth(t *testing.T) {
+	d := NewDispatcher(1, 2)
+	defer d.Stop()
+
+	release := make(chan struct{})
+	d.Dispatch("a", func() { <-release })
+	d.Dispatch("a", func() {})
+
+	blocked := make(chan error)
+	go func() {
+		blocked <- d.Dispatch("a", func() {})
+	}()
+	select {
+	case <-blocked:
+		t.Fatal("dispatch over depth not blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-blocked; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_DispatcherHandler(t *testing.T) {
+	d := NewDispatcher(2, 4)
+
+	var mutex sync.Mutex
+	var got []interface{}
+	handler := d.Handler(MessageHandlerFunc(func(session *Session, msg interface{}) {
+		mutex.Lock()
+		got = append(got, msg)
+		mutex.Unlock()
+	}))
+
+	session := NewSession(&listCodec{msgs: []interface{}{1, 2, 3, 4, 5, 6}}, 0)
+	handler.HandleSession(session)
+	d.Stop()
+
+	if len(got) != 6 {
+		t.Fatalf("messages not handled: %v", got)
+	}
+	for i, msg := range got {
+		if msg != i+1 {
+			t.Fatalf("messages out of order: %v", got)
+		}
+	}
+}
+
+func Test_DispatcherPanic(t *testing.T) {
+	d := NewDispatcher(1, 0)
+
+	var mutex sync.Mutex
+	var errs []error
+	d.SetErrorHook(func(session *Session, err error) {
+		mutex.Lock()
+		errs = append(errs, err)
+		mutex.Unlock()
+	})
+
+	ran := false
+	d.Dispatch("a", func() { panic("task") })
+	d.Dispatch("a", func() { ran = true })
+	d.Stop()
+
+	if !ran {
+		t.Fatal("queue stuck after a panic")
+	}
+	if len(errs) != 1 || errs[0].(*PanicError).Value != "task" {
+		t.Fatalf("panic not reported: %v", errs)
+	}
+}
+
+func Test_DispatcherWaiters(t *testing.T) {
+	d := NewDispatcher(2, 1)
+	defer d.Stop()
+
+	var ran int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				// a slow task lets the other producers wait on the queue it drains
+				err := d.Dispatch("a", func() {
+					time.Sleep(time.Millisecond)
+					atomic.AddInt32(&ran, 1)
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("producers of one key stuck")
+	}
+	d.Stop()
+	if n := atomic.LoadInt32(&ran); n != 80 {
+		t.Fatalf("%d of 80 tasks ran", n)
+	}
+}
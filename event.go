@@ -0,0 +1,95 @@
+package link
+
+import (
+	"runtime/debug"
+	"syscall"
+)
+
+// MessageHandler handles one received message in the event-driven mode.
+// It runs on a worker of a bounded pool, so it must not block for long.
+type MessageHandler interface {
+	HandleMessage(session *Session, msg interface{})
+}
+
+type MessageHandlerFunc func(session *Session, msg interface{})
+
+func (f MessageHandlerFunc) HandleMessage(session *Session, msg interface{}) {
+	f(session, msg)
+}
+
+// handleMessage runs the handler, a panic closes only this session with a *PanicError reason.
+func handleMessage(handler MessageHandler, session *Session, msg interface{}, hook ErrorHook) {
+	defer func() {
+		if v := recover(); v != nil {
+			err := &PanicError{v, debug.Stack()}
+			session.CloseWithReason(err)
+			if hook != nil {
+				hook(session, err)
+			}
+		}
+	}()
+	handler.HandleMessage(session, msg)
+}
+
+// serveMessages is the goroutine per connection fallback of the event-driven mode.
+func serveMessages(handler MessageHandler, hook ErrorHook) Handler {
+	return HandlerFunc(func(session *Session) {
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				session.Close()
+				return
+			}
+			handleMessage(handler, session, msg, hook)
+			if session.IsClosed() {
+				return
+			}
+		}
+	})
+}
+
+// ServeEvents serves connections without a goroutine per connection. On Linux
+// one goroutine waits for readable connections with epoll and hands them to
+// workers, which receive the buffered messages and pass them to handler.
+// A worker still blocks on a partly received message, so workers should exceed
+// the number of slow peers expected at once.
+// Sessions keep their API, a sendChanSize of 0 avoids the send goroutine too.
+// Other platforms, resumable sessions and connections without a file
+// descriptor fall back to a goroutine per connection.
+func (server *Server) ServeEvents(handler MessageHandler, workers int) error {
+	loop, err := newEventLoop(handler, workers, server.errorHook)
+	if err != nil {
+		return server.Serve(serveMessages(handler, server.errorHook))
+	}
+	server.events.Store(loop)
+	defer loop.stop()
+
+	for {
+		conn, err := server.accept()
+		if err != nil {
+			return err
+		}
+
+		raw, ok := conn.(syscall.Conn)
+		if !ok || server.resume != nil {
+			go server.serveConn(conn, serveMessages(handler, server.errorHook))
+			continue
+		}
+
+		session := server.createSession(conn)
+		if session == nil {
+			continue
+		}
+		if err = loop.add(raw, session); err != nil {
+			session.Close()
+		}
+	}
+}
+
+// readBuffered returns how many received bytes the codec of session holds.
+func readBuffered(session *Session) int {
+	if codec, ok := session.Codec().(ReadBufferedCodec); ok {
+		return codec.ReadBuffered()
+	}
+	return 0
+}
@@ -0,0 +1,172 @@
+package link
+
+import (
+	"sync"
+	"syscall"
+)
+
+const eventFlags = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+type eventConn struct {
+	fd      int
+	session *Session
+}
+
+// eventLoop arms every connection with EPOLLONESHOT, so a connection is
+// handed to one worker at a time and rearmed when the worker is done with it.
+type eventLoop struct {
+	epfd    int
+	wake    [2]int
+	handler MessageHandler
+	hook    ErrorHook
+	jobs    chan *eventConn
+	workers sync.WaitGroup
+
+	mutex sync.Mutex
+	conns map[int]*eventConn
+
+	stopOnce sync.Once
+}
+
+func newEventLoop(handler MessageHandler, workers int, hook ErrorHook) (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	loop := &eventLoop{
+		epfd:    epfd,
+		handler: handler,
+		hook:    hook,
+		jobs:    make(chan *eventConn, workers),
+		conns:   make(map[int]*eventConn),
+	}
+	if err = syscall.Pipe2(loop.wake[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(loop.wake[0])}
+	if err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, loop.wake[0], &event); err != nil {
+		loop.closeFds()
+		return nil, err
+	}
+
+	loop.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go loop.work()
+	}
+	go loop.run()
+	return loop, nil
+}
+
+func (loop *eventLoop) closeFds() {
+	syscall.Close(loop.wake[0])
+	syscall.Close(loop.wake[1])
+	syscall.Close(loop.epfd)
+}
+
+func (loop *eventLoop) add(conn syscall.Conn, session *Session) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fd int
+	if err = raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return err
+	}
+
+	ec := &eventConn{fd, session}
+	loop.mutex.Lock()
+	loop.conns[fd] = ec
+	loop.mutex.Unlock()
+
+	// closing the connection removes it from epoll, so only the map entry is
+	// dropped, an EPOLL_CTL_DEL could hit a new connection reusing the fd.
+	session.addCloseCallback(func(*Session) {
+		loop.mutex.Lock()
+		if loop.conns[fd] == ec {
+			delete(loop.conns, fd)
+		}
+		loop.mutex.Unlock()
+	})
+
+	event := syscall.EpollEvent{Events: eventFlags, Fd: int32(fd)}
+	return syscall.EpollCtl(loop.epfd, syscall.EPOLL_CTL_ADD, fd, &event)
+}
+
+func (loop *eventLoop) rearm(ec *eventConn) {
+	loop.mutex.Lock()
+	defer loop.mutex.Unlock()
+	if loop.conns[ec.fd] != ec || ec.session.IsClosed() {
+		return
+	}
+	event := syscall.EpollEvent{Events: eventFlags, Fd: int32(ec.fd)}
+	if syscall.EpollCtl(loop.epfd, syscall.EPOLL_CTL_MOD, ec.fd, &event) != nil {
+		ec.session.Close()
+	}
+}
+
+func (loop *eventLoop) run() {
+	defer func() {
+		close(loop.jobs)
+		loop.workers.Wait()
+		loop.closeFds()
+	}()
+
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		n, err := syscall.EpollWait(loop.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == loop.wake[0] {
+				return
+			}
+			loop.mutex.Lock()
+			ec := loop.conns[fd]
+			loop.mutex.Unlock()
+			if ec != nil {
+				loop.jobs <- ec
+			}
+		}
+	}
+}
+
+func (loop *eventLoop) work() {
+	defer loop.workers.Done()
+	for ec := range loop.jobs {
+		loop.process(ec)
+	}
+}
+
+// process receives one message and the ones the codec already buffered.
+func (loop *eventLoop) process(ec *eventConn) {
+	session := ec.session
+	for {
+		msg, err := session.Receive()
+		if err != nil {
+			session.Close()
+			return
+		}
+		handleMessage(loop.handler, session, msg, loop.hook)
+		if session.IsClosed() {
+			return
+		}
+		if readBuffered(session) == 0 {
+			break
+		}
+	}
+	loop.rearm(ec)
+}
+
+func (loop *eventLoop) stop() {
+	loop.stopOnce.Do(func() {
+		syscall.Write(loop.wake[1], []byte{0})
+	})
+}
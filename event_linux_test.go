@@ -0,0 +1,17 @@
+package link
+
+import "testing"
+
+// checkEventLoop fails unless the connections of server are served by epoll.
+func checkEventLoop(t *testing.T, server *Server) {
+	loop, ok := server.events.Load().(*eventLoop)
+	if !ok {
+		t.Fatal("event loop not started")
+	}
+	loop.mutex.Lock()
+	n := len(loop.conns)
+	loop.mutex.Unlock()
+	if n == 0 {
+		t.Fatal("connection not on the event loop")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package link
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errNoEventLoop = errors.New("event loop not supported on this platform.")
+
+type eventLoop struct{}
+
+func newEventLoop(handler MessageHandler, workers int, hook ErrorHook) (*eventLoop, error) {
+	return nil, errNoEventLoop
+}
+
+func (loop *eventLoop) add(conn syscall.Conn, session *Session) error {
+	return errNoEventLoop
+}
+
+func (loop *eventLoop) stop() {}
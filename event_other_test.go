@@ -0,0 +1,8 @@
+//go:build !linux
+
+package link
+
+import "testing"
+
+// checkEventLoop does nothing, other platforms fall back to a goroutine per connection.
+func checkEventLoop(t *testing.T, server *Server) {}
@@ -0,0 +1,113 @@
+package link
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_ServeEvents(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(l, uint64Protocol{}, 0)
+	defer server.Stop()
+
+	go server.ServeEvents(MessageHandlerFunc(func(session *Session, msg interface{}) {
+		if msg.(uint64) == 0 {
+			panic("zero")
+		}
+		session.Send(msg.(uint64) + 1)
+	}), 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			codec := &uint64Codec{conn}
+			defer codec.Close()
+
+			for i := uint64(1); i <= 50; i++ {
+				if err := codec.Send(i); err != nil {
+					t.Error(err)
+					return
+				}
+				msg, err := codec.Receive()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if msg != i+1 {
+					t.Errorf("message not match: %v, %v", msg, i+1)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the connection is served by the event loop, not a goroutine of its own
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := &uint64Codec{conn}
+	if err := served.Send(uint64(1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := served.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	checkEventLoop(t, server)
+	served.Close()
+
+	// a panicking handler closes only its own connection
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := &uint64Codec{conn}
+	defer codec.Close()
+	codec.Send(uint64(0))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := codec.Receive(); err == nil {
+		t.Fatal("session not closed after panic")
+	}
+}
+
+func Test_SpeedCounter(t *testing.T) {
+	sc := NewSpeedCounter()
+	sc.Add(50)
+	if sc.Current() != 0 {
+		t.Fatal("window closed early")
+	}
+
+	sc.start -= int64(2 * UPDATE_INTERVAL * time.Second)
+	sc.Add(1)
+	if sc.Current() != 2 || sc.All != 50 {
+		t.Fatalf("speed not match: %d, %d", sc.Current(), sc.All)
+	}
+}
+
+func Test_SpeedCounterUpdate(t *testing.T) {
+	sc := NewSpeedCounter()
+	done := make(chan struct{})
+	go func() {
+		sc.Update()
+		close(done)
+	}()
+	sc.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Update not stopped by Close")
+	}
+}
@@ -27,6 +27,9 @@ func main() {
 	server := link.NewServer(l, json, 0 /* sync send */)
 	checkErr(err)
 	addr := server.Listener().Addr().String()
+	server.SetErrorHook(func(session *link.Session, err error) {
+		log.Printf("handler error: %v", err)
+	})
 	go server.Serve(link.HandlerFunc(serverSessionLoop))
 
 	client := link.NewClient(link.DialerFunc(func() (net.Conn, error) {
@@ -39,14 +42,19 @@ func main() {
 }
 
 func serverSessionLoop(session *link.Session) {
+	defer session.Close()
 	for {
 		req, err := session.Receive()
-		checkErr(err)
+		if err != nil {
+			return
+		}
 
 		err = session.Send(&AddRsp{
 			req.(*AddReq).A + req.(*AddReq).B,
 		})
-		checkErr(err)
+		if err != nil {
+			return
+		}
 	}
 }
 
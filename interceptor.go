@@ -0,0 +1,118 @@
+package link
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+type SendFunc func(msg interface{}) error
+
+type ReceiveFunc func() (interface{}, error)
+
+// SendInterceptor wraps every codec send of a session, it calls next to continue the chain.
+type SendInterceptor func(session *Session, msg interface{}, next SendFunc) error
+
+// ReceiveInterceptor wraps every codec receive of a session, it calls next to continue the chain.
+type ReceiveInterceptor func(session *Session, next ReceiveFunc) (interface{}, error)
+
+// SetInterceptors wraps the codec calls of the session, the first interceptor
+// is the outermost. A send interceptor returning an error without calling next
+// drops the message, the session stays open. In the batch mode of an async
+// session the send interceptors return after the batch is flushed.
+// It must be called before the first Send or Receive.
+func (session *Session) SetInterceptors(send []SendInterceptor, receive []ReceiveInterceptor) {
+	session.sendFunc = nil
+	session.sendInterceptors = nil
+	session.receiveFunc = nil
+
+	if len(send) > 0 {
+		session.sendFunc = chainSend(session, send, session.send)
+		session.sendInterceptors = send
+	}
+	if len(receive) > 0 {
+		session.receiveFunc = chainReceive(session, receive, session.receive)
+	}
+}
+
+func chainSend(session *Session, interceptors []SendInterceptor, final SendFunc) SendFunc {
+	next := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, n := interceptors[i], next
+		next = func(msg interface{}) error {
+			return interceptor(session, msg, n)
+		}
+	}
+	return next
+}
+
+func chainReceive(session *Session, interceptors []ReceiveInterceptor, final ReceiveFunc) ReceiveFunc {
+	next := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, n := interceptors[i], next
+		next = func() (interface{}, error) {
+			return interceptor(session, n)
+		}
+	}
+	return next
+}
+
+// PanicError is a recovered panic with the stack of the panicking goroutine.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// RecoverSend turns a panic in the rest of the send chain into a *PanicError.
+func RecoverSend() SendInterceptor {
+	return func(session *Session, msg interface{}, next SendFunc) (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = &PanicError{v, debug.Stack()}
+			}
+		}()
+		return next(msg)
+	}
+}
+
+// RecoverReceive turns a panic in the rest of the receive chain into a *PanicError.
+func RecoverReceive() ReceiveInterceptor {
+	return func(session *Session, next ReceiveFunc) (msg interface{}, err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				msg, err = nil, &PanicError{v, debug.Stack()}
+			}
+		}()
+		return next()
+	}
+}
+
+// LogSend logs every sent message type and the send error.
+func LogSend(logger *log.Logger) SendInterceptor {
+	return func(session *Session, msg interface{}, next SendFunc) error {
+		err := next(msg)
+		if err != nil {
+			logger.Printf("session %d send %T: %v", session.ID(), msg, err)
+		} else {
+			logger.Printf("session %d send %T", session.ID(), msg)
+		}
+		return err
+	}
+}
+
+// LogReceive logs every received message type and the receive error.
+func LogReceive(logger *log.Logger) ReceiveInterceptor {
+	return func(session *Session, next ReceiveFunc) (interface{}, error) {
+		msg, err := next()
+		if err != nil {
+			logger.Printf("session %d receive: %v", session.ID(), err)
+		} else {
+			logger.Printf("session %d receive %T", session.ID(), msg)
+		}
+		return msg, err
+	}
+}
@@ -0,0 +1,91 @@
+package link
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+type panicCodec struct {
+	seqCodec
+}
+
+func (c *panicCodec) Send(msg interface{}) error {
+	panic("send")
+}
+
+func Test_Interceptors(t *testing.T) {
+	var order []string
+	trace := func(name string) SendInterceptor {
+		return func(session *Session, msg interface{}, next SendFunc) error {
+			order = append(order, name)
+			return next(msg)
+		}
+	}
+
+	var logs bytes.Buffer
+	logger := log.New(&logs, "", 0)
+	session := NewSession(new(panicCodec), 0)
+	session.SetInterceptors(
+		[]SendInterceptor{trace("a"), LogSend(logger), RecoverSend(), trace("b")},
+		[]ReceiveInterceptor{LogReceive(logger)},
+	)
+
+	err := session.Send(1)
+	if e, ok := err.(*PanicError); !ok || e.Value != "send" || len(e.Stack) == 0 {
+		t.Fatalf("panic not recovered: %v", err)
+	}
+	if strings.Join(order, ",") != "a,b" {
+		t.Fatalf("interceptor order not match: %v", order)
+	}
+
+	if _, err := session.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "send int: panic: send") || !strings.Contains(lines[1], "receive int") {
+		t.Fatalf("log not match: %q", logs.String())
+	}
+}
+
+func Test_InterceptorReject(t *testing.T) {
+	codec := newBatchTestCodec()
+	close(codec.release)
+	session := NewSession(codec, 10)
+	defer session.Close()
+
+	// the interceptor of a message returns after its batch is flushed
+	flushed := make(chan bool, 4)
+	session.SetInterceptors([]SendInterceptor{
+		func(session *Session, msg interface{}, next SendFunc) error {
+			if msg.(int)%2 == 1 {
+				return errors.New("rejected")
+			}
+			err := next(msg)
+			codec.Lock()
+			flushed <- err == nil && codec.buffered == 0
+			codec.Unlock()
+			return err
+		},
+	}, nil)
+
+	for i := 0; i < 4; i++ {
+		if err := session.Send(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent := codec.waitFlushed(t, 2)
+	if len(sent) != 2 || sent[0] != 0 || sent[1] != 2 {
+		t.Fatalf("sent messages not match: %v", sent)
+	}
+	for i := 0; i < 2; i++ {
+		if !<-flushed {
+			t.Fatal("interceptor returned before the flush")
+		}
+	}
+	if session.IsClosed() {
+		t.Fatal("rejected message closed the session")
+	}
+}
@@ -1,12 +1,15 @@
 package link
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 const sessionMapNum = 32
 
 type Manager struct {
 	sessionMaps [sessionMapNum]sessionMap
-	disposeFlag bool
+	disposeFlag int32
 	disposeOnce sync.Once
 	disposeWait sync.WaitGroup
 }
@@ -26,7 +29,7 @@ func NewManager() *Manager {
 
 func (manager *Manager) Dispose() {
 	manager.disposeOnce.Do(func() {
-		manager.disposeFlag = true
+		atomic.StoreInt32(&manager.disposeFlag, 1)
 		for i := 0; i < sessionMapNum; i++ {
 			smap := &manager.sessionMaps[i]
 			smap.Lock()
@@ -40,7 +43,10 @@ func (manager *Manager) Dispose() {
 }
 
 func (manager *Manager) NewSession(codec Codec, sendChanSize int) *Session {
-	session := NewSession(codec, sendChanSize)
+	return manager.manage(NewSession(codec, sendChanSize))
+}
+
+func (manager *Manager) manage(session *Session) *Session {
 	session.addCloseCallback(manager.delSession)
 	manager.putSession(session)
 	return session
@@ -88,7 +94,7 @@ func (manager *Manager) putSession(session *Session) {
 }
 
 func (manager *Manager) delSession(session *Session) {
-	if manager.disposeFlag {
+	if atomic.LoadInt32(&manager.disposeFlag) == 1 {
 		//avoid deadload
 		manager.disposeWait.Done()
 		return
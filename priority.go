@@ -0,0 +1,83 @@
+package link
+
+import "time"
+
+// Priority selects the send lane of an async session, lower values go out first.
+type Priority int
+
+const (
+	PriorityControl Priority = iota
+	PriorityNormal
+	PriorityBulk
+	numPriorities
+)
+
+// SetLaneWeights switches the send loop from strict priority to weighted
+// round robin between the non-empty lanes, weights are indexed by Priority.
+// No weights means strict priority.
+func (session *Session) SetLaneWeights(weights ...int) {
+	var laneWeights []int
+	if len(weights) > 0 {
+		laneWeights = make([]int, numPriorities)
+		for i := range laneWeights {
+			laneWeights[i] = 1
+			if i < len(weights) && weights[i] > 0 {
+				laneWeights[i] = weights[i]
+			}
+		}
+	}
+	session.laneWeights.Store(laneWeights)
+}
+
+// pollMessage takes the next queued message without blocking, it is only called by the send loop.
+func (session *Session) pollMessage() (interface{}, bool) {
+	weights, _ := session.laneWeights.Load().([]int)
+	if weights == nil {
+		for _, sendChan := range session.sendChans {
+			select {
+			case msg := <-sendChan:
+				return msg, true
+			default:
+			}
+		}
+		return nil, false
+	}
+
+	// smooth weighted round robin, the send loop is the only reader so a non-empty lane stays non-empty
+	next, total := -1, 0
+	for i, sendChan := range session.sendChans {
+		if len(sendChan) == 0 {
+			continue
+		}
+		session.laneCredits[i] += weights[i]
+		total += weights[i]
+		if next < 0 || session.laneCredits[i] > session.laneCredits[next] {
+			next = i
+		}
+	}
+	if next < 0 {
+		return nil, false
+	}
+	session.laneCredits[next] -= total
+	return <-session.sendChans[next], true
+}
+
+// waitMessage blocks until a message is queued, timeout fires or the session is closed.
+func (session *Session) waitMessage(timeout <-chan time.Time) (interface{}, bool, error) {
+	if msg, ok := session.pollMessage(); ok {
+		return msg, true, nil
+	}
+
+	select {
+	case msg := <-session.sendChans[PriorityControl]:
+		return msg, true, nil
+	case msg := <-session.sendChans[PriorityNormal]:
+		return msg, true, nil
+	case msg := <-session.sendChans[PriorityBulk]:
+		return msg, true, nil
+	case <-timeout:
+		return nil, false, nil
+	case <-session.closeChan:
+		return nil, false, SessionClosedError
+	}
+}
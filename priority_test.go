@@ -0,0 +1,65 @@
+package link
+
+import "testing"
+
+func sendLanes(t *testing.T, session *Session, codec *batchTestCodec, msgs map[Priority][]int) []interface{} {
+	// the first message blocks the send loop until everything else is queued
+	session.SendPriority(-1, PriorityNormal)
+	<-codec.blocked
+	n := 1
+	for _, priority := range []Priority{PriorityBulk, PriorityNormal, PriorityControl} {
+		for _, msg := range msgs[priority] {
+			if err := session.SendPriority(msg, priority); err != nil {
+				t.Fatal(err)
+			}
+			n++
+		}
+	}
+	close(codec.release)
+	return codec.waitFlushed(t, n)[1:]
+}
+
+func Test_StrictPriority(t *testing.T) {
+	codec := newBatchTestCodec()
+	session := NewSession(codec, 10)
+	defer session.Close()
+
+	sent := sendLanes(t, session, codec, map[Priority][]int{
+		PriorityBulk:    {5, 6},
+		PriorityNormal:  {3, 4},
+		PriorityControl: {1, 2},
+	})
+	for i, msg := range sent {
+		if msg != i+1 {
+			t.Fatalf("message order not match: %v", sent)
+		}
+	}
+
+	if err := session.SendPriority(0, numPriorities); err != ErrInvalidPriority {
+		t.Fatalf("invalid priority accepted: %v", err)
+	}
+}
+
+func Test_WeightedPriority(t *testing.T) {
+	codec := newBatchTestCodec()
+	session := NewSession(codec, 10)
+	session.SetLaneWeights(1, 3, 1)
+	defer session.Close()
+
+	sent := sendLanes(t, session, codec, map[Priority][]int{
+		PriorityBulk:   {100, 101, 102, 103},
+		PriorityNormal: {0, 1, 2, 3},
+	})
+	if len(sent) != 8 {
+		t.Fatalf("messages lost: %v", sent)
+	}
+	bulk := 0
+	for _, msg := range sent[:4] {
+		if msg.(int) >= 100 {
+			bulk++
+		}
+	}
+	if bulk != 1 {
+		t.Fatalf("lanes not weighted 3:1: %v", sent)
+	}
+}
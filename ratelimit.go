@@ -0,0 +1,224 @@
+package link
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimitAction is what Session.Receive does with a message over the limit.
+type RateLimitAction int
+
+const (
+	// RateLimitDelay holds the message until the bucket refills, the peer is slowed down by TCP back pressure.
+	RateLimitDelay RateLimitAction = iota
+	// RateLimitDrop discards the message and receives the next one.
+	RateLimitDrop
+	// RateLimitClose closes the session with ErrRateLimited.
+	RateLimitClose
+)
+
+// RateLimit configures token buckets for inbound messages and bytes.
+// A zero rate disables that bucket, a zero burst allows one second of traffic.
+type RateLimit struct {
+	Messages     float64
+	MessageBurst int
+	Bytes        float64
+	ByteBurst    int
+	Action       RateLimitAction
+}
+
+// RateLimiter polices inbound traffic, one RateLimiter can be shared by many sessions.
+type RateLimiter struct {
+	messages *tokenBucket
+	bytes    *tokenBucket
+	action   RateLimitAction
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		messages: newTokenBucket(limit.Messages, limit.MessageBurst),
+		bytes:    newTokenBucket(limit.Bytes, limit.ByteBurst),
+		action:   limit.Action,
+	}
+}
+
+// take charges one message of n bytes, it returns how long to delay the
+// message for RateLimitDelay or whether it is allowed for the other actions.
+func (limiter *RateLimiter) take(n int) (time.Duration, bool) {
+	if limiter.action == RateLimitDelay {
+		wait := limiter.messages.take(1)
+		if byteWait := limiter.bytes.take(float64(n)); byteWait > wait {
+			wait = byteWait
+		}
+		return wait, true
+	}
+
+	if !limiter.messages.tryTake(1) {
+		return 0, false
+	}
+	if !limiter.bytes.tryTake(float64(n)) {
+		limiter.messages.refund(1)
+		return 0, false
+	}
+	return 0, true
+}
+
+// refund gives back a message of n bytes that was not accepted.
+func (limiter *RateLimiter) refund(n int) {
+	limiter.messages.refund(1)
+	limiter.bytes.refund(float64(n))
+}
+
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(rate)
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take removes n tokens even into debt and returns how long until the debt is paid.
+func (b *tokenBucket) take(n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// tryTake removes n tokens if they are available, a request larger than
+// the burst only needs a full bucket.
+func (b *tokenBucket) tryTake(n float64) bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	need := n
+	if need > b.burst {
+		need = b.burst
+	}
+	if b.tokens < need {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+func (b *tokenBucket) refund(n float64) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.tokens += n
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// byteMeter counts the bytes read from the connection of a session.
+type byteMeter struct {
+	n uint64
+}
+
+// since returns the bytes read since the last call.
+func (m *byteMeter) since() int {
+	if m == nil {
+		return 0
+	}
+	return int(atomic.SwapUint64(&m.n, 0))
+}
+
+// meteredConn counts the bytes read for the byte limits of the session.
+type meteredConn struct {
+	net.Conn
+	meter *byteMeter
+}
+
+func meterConn(conn net.Conn) (net.Conn, *byteMeter) {
+	meter := new(byteMeter)
+	return &meteredConn{conn, meter}, meter
+}
+
+// WriteBuffers keeps the writev of the connection for codecs writing net.Buffers.
+func (conn *meteredConn) WriteBuffers(vec *net.Buffers) (int64, error) {
+	return vec.WriteTo(conn.Conn)
+}
+
+func (conn *meteredConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	atomic.AddUint64(&conn.meter.n, uint64(n))
+	return n, err
+}
+
+// SetRateLimit polices Receive with the limiters in order, a limiter can be
+// shared by many sessions as a global budget. A message rejected by one
+// limiter is given back to the limiters before it. Bytes are counted for
+// sessions created on a connection by Server, Client and CreateSession, a
+// codec passed to NewSession has no connection to count. It must be called
+// before the first Receive.
+func (session *Session) SetRateLimit(limiters ...*RateLimiter) {
+	session.limiters = limiters
+}
+
+// allow applies the rate limiters to a received message.
+func (session *Session) allow() (bool, error) {
+	n := session.meter.since()
+	for i, limiter := range session.limiters {
+		wait, ok := limiter.take(n)
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-session.closeChan:
+				timer.Stop()
+				return false, SessionClosedError
+			}
+		}
+		if !ok {
+			for _, taken := range session.limiters[:i] {
+				taken.refund(n)
+			}
+			if limiter.action == RateLimitClose {
+				session.CloseWithReason(ErrRateLimited)
+				return false, ErrRateLimited
+			}
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,122 @@
+package link
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type seqCodec struct {
+	next int
+}
+
+func (c *seqCodec) Receive() (interface{}, error) {
+	c.next++
+	return c.next, nil
+}
+
+func (c *seqCodec) Send(msg interface{}) error { return nil }
+func (c *seqCodec) Close() error               { return nil }
+
+func Test_RateLimitDelay(t *testing.T) {
+	session := NewSession(new(seqCodec), 0)
+	session.SetRateLimit(NewRateLimiter(RateLimit{Messages: 100, MessageBurst: 1}))
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if _, err := session.Receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 25*time.Millisecond {
+		t.Fatalf("messages not delayed: %v", d)
+	}
+}
+
+func Test_RateLimitDrop(t *testing.T) {
+	session := NewSession(new(seqCodec), 0)
+	session.SetRateLimit(NewRateLimiter(RateLimit{Messages: 10, MessageBurst: 2, Action: RateLimitDrop}))
+
+	for _, expected := range []int{1, 2} {
+		msg, err := session.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != expected {
+			t.Fatalf("message not match: %v, %v", msg, expected)
+		}
+	}
+	msg, err := session.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.(int) <= 3 {
+		t.Fatalf("message over the limit not dropped: %v", msg)
+	}
+}
+
+func Test_RateLimitClose(t *testing.T) {
+	session := NewSession(new(seqCodec), 0)
+	global := NewRateLimiter(RateLimit{Messages: 1, MessageBurst: 1, Action: RateLimitClose})
+	session.SetRateLimit(NewRateLimiter(RateLimit{Messages: 1000}), global)
+
+	if _, err := session.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Receive(); err != ErrRateLimited {
+		t.Fatalf("rate limit not enforced: %v", err)
+	}
+	if !session.IsClosed() || session.CloseReason() != ErrRateLimited {
+		t.Fatalf("session not closed with reason: %v", session.CloseReason())
+	}
+}
+
+func Test_TokenBucket(t *testing.T) {
+	bucket := newTokenBucket(1000, 100)
+	if !bucket.tryTake(100) || bucket.tryTake(1) {
+		t.Fatal("burst not enforced")
+	}
+	if wait := bucket.take(100); wait < 90*time.Millisecond {
+		t.Fatalf("debt not paid back: %v", wait)
+	}
+	if newTokenBucket(0, 0).take(1) != 0 || !newTokenBucket(0, 0).tryTake(1) {
+		t.Fatal("zero rate should disable the bucket")
+	}
+}
+
+func Test_RateLimitBytes(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	session, _ := CreateSession(conn, uint64Protocol{}, 0)
+	defer session.Close()
+	session.SetRateLimit(NewRateLimiter(RateLimit{Bytes: 1, ByteBurst: 8, Action: RateLimitClose}))
+
+	go func() {
+		codec, _ := uint64Protocol{}.NewCodec(peer)
+		codec.Send(uint64(1))
+		codec.Send(uint64(2))
+	}()
+	if _, err := session.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Receive(); err != ErrRateLimited {
+		t.Fatalf("byte limit not enforced: %v", err)
+	}
+}
+
+func Test_RateLimitRefund(t *testing.T) {
+	session := NewSession(new(seqCodec), 0)
+	first := NewRateLimiter(RateLimit{Messages: 0.001, MessageBurst: 2, Action: RateLimitDrop})
+	second := NewRateLimiter(RateLimit{Messages: 0.001, MessageBurst: 1, Action: RateLimitDrop})
+	session.SetRateLimit(first, second)
+
+	for i, expected := range []bool{true, false, false} {
+		if ok, err := session.allow(); ok != expected || err != nil {
+			t.Fatalf("message %d allowed %v: %v", i, ok, err)
+		}
+	}
+	// the messages rejected by the second limiter were given back to the first
+	if !first.messages.tryTake(1) {
+		t.Fatal("tokens not refunded")
+	}
+}
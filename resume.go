@@ -0,0 +1,305 @@
+package link
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// ResumeToken identifies a resumable session across reconnects.
+// The zero token asks the server for a new session.
+type ResumeToken [16]byte
+
+const resumeHandshakeSize = 16 + 8
+
+// resumeHandshakeTimeout limits the handshake, a peer that connects and stays
+// silent doesn't hold the connection.
+const resumeHandshakeTimeout = 10 * time.Second
+
+func newResumeToken() (token ResumeToken, err error) {
+	_, err = io.ReadFull(rand.Reader, token[:])
+	return
+}
+
+// The handshake is exchanged on the raw connection before the codec is created:
+// a token followed by the number of messages the writer has received so far.
+func writeResumeHandshake(w io.Writer, token ResumeToken, received uint64) error {
+	var buf [resumeHandshakeSize]byte
+	copy(buf[:16], token[:])
+	binary.BigEndian.PutUint64(buf[16:], received)
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func readResumeHandshake(r io.Reader) (token ResumeToken, received uint64, err error) {
+	var buf [resumeHandshakeSize]byte
+	if _, err = io.ReadFull(r, buf[:]); err != nil {
+		return
+	}
+	copy(token[:], buf[:16])
+	received = binary.BigEndian.Uint64(buf[16:])
+	return
+}
+
+type redialFunc func(token ResumeToken, received uint64) (codec Codec, peerReceived uint64, err error)
+
+type sessionResume struct {
+	token   ResumeToken
+	timeout time.Duration
+	redial  redialFunc
+
+	// sendMutex keeps the writes in sequence order, mutex guards the
+	// state and is never held while writing, so Close is not blocked.
+	sendMutex  sync.Mutex
+	mutex      sync.Mutex
+	codec      Codec
+	attached   bool
+	attachChan chan struct{}
+	detachGen  uint64
+
+	sent     uint64
+	received uint64
+	replay   []interface{}
+}
+
+func newSessionResume(codec Codec, token ResumeToken, bufferSize int, timeout time.Duration, redial redialFunc) *sessionResume {
+	return &sessionResume{
+		token:      token,
+		timeout:    timeout,
+		redial:     redial,
+		codec:      codec,
+		attached:   true,
+		attachChan: make(chan struct{}),
+		replay:     make([]interface{}, bufferSize),
+	}
+}
+
+func (r *sessionResume) currentCodec() Codec {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.codec
+}
+
+func (r *sessionResume) receivedCount() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.received
+}
+
+// missed returns the buffered messages the peer has not received yet.
+// Message sequence numbers start at 1, message seq is kept at replay[(seq-1)%len(replay)].
+func (r *sessionResume) missed(peerReceived uint64) ([]interface{}, bool) {
+	if peerReceived > r.sent || r.sent-peerReceived > uint64(len(r.replay)) {
+		return nil, false
+	}
+	msgs := make([]interface{}, 0, r.sent-peerReceived)
+	for seq := peerReceived + 1; seq <= r.sent; seq++ {
+		msgs = append(msgs, r.replay[(seq-1)%uint64(len(r.replay))])
+	}
+	return msgs, true
+}
+
+func (r *sessionResume) receive(session *Session) (interface{}, error) {
+	for {
+		r.mutex.Lock()
+		codec, attached, attachChan := r.codec, r.attached, r.attachChan
+		r.mutex.Unlock()
+
+		if !attached {
+			select {
+			case <-attachChan:
+				continue
+			case <-session.closeChan:
+				return nil, SessionClosedError
+			}
+		}
+
+		msg, err := codec.Receive()
+		if err == nil {
+			r.mutex.Lock()
+			current := r.attached && r.codec == codec
+			if current {
+				r.received++
+			}
+			r.mutex.Unlock()
+			if current {
+				return msg, nil
+			}
+			// the peer will replay this message on the new connection
+			continue
+		}
+
+		if session.IsClosed() {
+			return nil, err
+		}
+		r.detach(session, codec)
+	}
+}
+
+// send returns the write error, the message is kept in the replay buffer
+// and sent again once the session is reattached.
+func (r *sessionResume) send(session *Session, msg interface{}) error {
+	r.sendMutex.Lock()
+	r.mutex.Lock()
+	r.sent++
+	if len(r.replay) > 0 {
+		r.replay[(r.sent-1)%uint64(len(r.replay))] = msg
+	}
+	codec, attached := r.codec, r.attached
+	r.mutex.Unlock()
+
+	if !attached {
+		r.sendMutex.Unlock()
+		return nil
+	}
+	err := codec.Send(msg)
+	r.sendMutex.Unlock()
+
+	if err != nil && !session.IsClosed() {
+		r.detach(session, codec)
+	}
+	return err
+}
+
+func (r *sessionResume) detach(session *Session, codec Codec) {
+	r.mutex.Lock()
+	if r.codec != codec || !r.attached {
+		r.mutex.Unlock()
+		return
+	}
+	r.attached = false
+	r.attachChan = make(chan struct{})
+	r.detachGen++
+	gen := r.detachGen
+	r.mutex.Unlock()
+
+	codec.Close()
+
+	time.AfterFunc(r.timeout, func() {
+		r.mutex.Lock()
+		expired := !r.attached && r.detachGen == gen
+		r.mutex.Unlock()
+		if expired {
+			session.Close()
+		}
+	})
+
+	if r.redial != nil {
+		go r.reconnect(session)
+	}
+}
+
+// takeOver detaches the codec of a half-open connection before the peer is
+// told what was received, a message still arriving on it is not counted and
+// the peer replays it on the new connection.
+func (r *sessionResume) takeOver(session *Session) uint64 {
+	r.detach(session, r.currentCodec())
+	return r.receivedCount()
+}
+
+// attach replaces the session codec and replays what the peer missed.
+func (r *sessionResume) attach(session *Session, codec Codec, peerReceived uint64) error {
+	r.mutex.Lock()
+	old, wasAttached := r.codec, r.attached
+	r.mutex.Unlock()
+	if wasAttached {
+		// half-open connection, the peer already gave up on it,
+		// closing it fails a send blocked on it
+		old.Close()
+	}
+
+	r.sendMutex.Lock()
+	defer r.sendMutex.Unlock()
+
+	r.mutex.Lock()
+	msgs, ok := r.missed(peerReceived)
+	r.mutex.Unlock()
+	if !ok {
+		return ErrResumeRejected
+	}
+	for _, msg := range msgs {
+		if err := codec.Send(msg); err != nil {
+			return err
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if session.IsClosed() {
+		return SessionClosedError
+	}
+	r.codec = codec
+	if !r.attached {
+		close(r.attachChan)
+	}
+	r.attached = true
+	return nil
+}
+
+func (r *sessionResume) reconnect(session *Session) {
+	var delay time.Duration
+	deadline := time.Now().Add(r.timeout)
+
+	for !session.IsClosed() && time.Now().Before(deadline) {
+		codec, peerReceived, err := r.redial(r.token, r.receivedCount())
+		if err == nil {
+			err = r.attach(session, codec, peerReceived)
+			if err == nil {
+				return
+			}
+			codec.Close()
+		}
+		if err == ErrResumeRejected || err == SessionClosedError {
+			session.Close()
+			return
+		}
+
+		if delay == 0 {
+			delay = 5 * time.Millisecond
+		} else {
+			delay *= 2
+		}
+		if max := 1 * time.Second; delay > max {
+			delay = max
+		}
+		time.Sleep(delay)
+	}
+}
+
+type resumeRegistry struct {
+	sync.Mutex
+	sessions         map[ResumeToken]*Session
+	bufferSize       int
+	timeout          time.Duration
+	handshakeTimeout time.Duration
+}
+
+func newResumeRegistry(bufferSize int, timeout time.Duration) *resumeRegistry {
+	return &resumeRegistry{
+		sessions:         make(map[ResumeToken]*Session),
+		bufferSize:       bufferSize,
+		timeout:          timeout,
+		handshakeTimeout: resumeHandshakeTimeout,
+	}
+}
+
+func (registry *resumeRegistry) get(token ResumeToken) *Session {
+	registry.Lock()
+	defer registry.Unlock()
+	return registry.sessions[token]
+}
+
+func (registry *resumeRegistry) put(session *Session) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.sessions[session.resume.token] = session
+	session.addCloseCallback(registry.del)
+}
+
+func (registry *resumeRegistry) del(session *Session) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.sessions, session.resume.token)
+}
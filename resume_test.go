@@ -0,0 +1,225 @@
+package link
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type uint64Protocol struct{}
+
+func (uint64Protocol) NewCodec(rw io.ReadWriter) (Codec, error) {
+	return &uint64Codec{rw: rw}, nil
+}
+
+type uint64Codec struct {
+	rw io.ReadWriter
+}
+
+func (c *uint64Codec) Receive() (interface{}, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(c.rw, buf[:]); err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func (c *uint64Codec) Send(msg interface{}) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], msg.(uint64))
+	_, err := c.rw.Write(buf[:])
+	return err
+}
+
+func (c *uint64Codec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func Test_ResumeMissed(t *testing.T) {
+	r := newSessionResume(nil, ResumeToken{}, 4, time.Second, nil)
+	for i := uint64(1); i <= 6; i++ {
+		r.sent = i
+		r.replay[(i-1)%4] = i
+	}
+
+	msgs, ok := r.missed(3)
+	if !ok || len(msgs) != 3 || msgs[0] != uint64(4) || msgs[2] != uint64(6) {
+		t.Fatalf("missed not match: %v, %v", msgs, ok)
+	}
+	if _, ok := r.missed(1); ok {
+		t.Fatal("gap larger than the replay buffer should be rejected")
+	}
+	if _, ok := r.missed(7); ok {
+		t.Fatal("peer received more than sent should be rejected")
+	}
+}
+
+func Test_Resume(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(l, uint64Protocol{}, 0)
+	server.EnableResume(16, 5*time.Second)
+	defer server.Stop()
+
+	var handled sync.WaitGroup
+	handled.Add(1)
+	go server.Serve(HandlerFunc(func(session *Session) {
+		handled.Done()
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				return
+			}
+			session.Send(msg)
+		}
+	}))
+
+	var connMutex sync.Mutex
+	var lastConn net.Conn
+	client := NewClient(DialerFunc(func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		connMutex.Lock()
+		lastConn = conn
+		connMutex.Unlock()
+		return conn, err
+	}), uint64Protocol{}, 1, 0, 0)
+	client.EnableResume(16, 5*time.Second)
+	defer client.Stop()
+
+	session, err := client.GetSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := session.ID()
+
+	for i := uint64(1); i <= 6; i++ {
+		if i == 4 {
+			connMutex.Lock()
+			lastConn.Close()
+			connMutex.Unlock()
+		}
+		// the write on the closed connection fails, the message is replayed
+		if err := session.Send(i); err != nil && i != 4 {
+			t.Fatal(err)
+		}
+		msg, err := session.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.(uint64) != i {
+			t.Fatalf("message not match: %v, %v", msg, i)
+		}
+	}
+
+	handled.Wait()
+	if session.ID() != id || session.IsClosed() {
+		t.Fatal("session not resumed")
+	}
+	if len(server.manager.GetSessions()) != 1 {
+		t.Fatal("server created a new session on reconnect")
+	}
+}
+
+// sendingCodec tells when a Send starts.
+type sendingCodec struct {
+	Codec
+	sending chan struct{}
+}
+
+func (c *sendingCodec) Send(msg interface{}) error {
+	c.sending <- struct{}{}
+	return c.Codec.Send(msg)
+}
+
+func Test_ResumeCloseWhileSending(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	base, _ := uint64Protocol{}.NewCodec(conn)
+	codec := &sendingCodec{base, make(chan struct{}, 1)}
+	session := newSession(codec, 0, newSessionResume(codec, ResumeToken{}, 4, time.Second, nil))
+
+	sent := make(chan error)
+	go func() {
+		// nobody reads the peer, the write blocks
+		sent <- session.Send(uint64(1))
+	}()
+	<-codec.sending
+
+	closed := make(chan struct{})
+	go func() {
+		session.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked by a pending write")
+	}
+	if err := <-sent; err == nil {
+		t.Fatal("write error not returned")
+	}
+}
+
+func Test_ResumeHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(l, uint64Protocol{}, 0)
+	server.EnableResume(16, 5*time.Second)
+	server.resume.handshakeTimeout = 50 * time.Millisecond
+	defer server.Stop()
+	go server.Serve(HandlerFunc(func(session *Session) {}))
+
+	// the client never sends its handshake, the server hangs up
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("silent client not dropped: %v", err)
+	}
+}
+
+func Test_ResumeTakeOver(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	codec, _ := uint64Protocol{}.NewCodec(conn)
+	session := newSession(codec, 0, newSessionResume(codec, ResumeToken{}, 4, time.Second, nil))
+	defer session.Close()
+
+	received := make(chan interface{})
+	go func() {
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+	peerCodec, _ := uint64Protocol{}.NewCodec(peer)
+	peerCodec.Send(uint64(1))
+	<-received
+
+	// the old connection is closed before the count is taken, nothing more is counted on it
+	if count := session.resume.takeOver(session); count != 1 {
+		t.Fatalf("received count not match: %d", count)
+	}
+	if err := peerCodec.Send(uint64(2)); err == nil {
+		t.Fatal("old connection still open")
+	}
+	if count := session.resume.receivedCount(); count != 1 {
+		t.Fatalf("message counted after the take over: %d", count)
+	}
+}
@@ -0,0 +1,191 @@
+package link
+
+import (
+	"reflect"
+	"runtime/debug"
+	"sync"
+)
+
+// TypeRegistry lists the message types a Protocol decodes, as the types
+// Receive returns them. codec.JsonProtocol and codec.ProtobufProtocol implement it.
+type TypeRegistry interface {
+	MessageTypes() []reflect.Type
+}
+
+var (
+	sessionType = reflect.TypeOf((*Session)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+type routeJob struct {
+	session *Session
+	msg     interface{}
+}
+
+type route struct {
+	fn   reflect.Value
+	jobs chan routeJob
+}
+
+func (r *route) call(session *Session, msg interface{}) error {
+	out := r.fn.Call([]reflect.Value{reflect.ValueOf(session), reflect.ValueOf(msg)})
+	err, _ := out[0].Interface().(error)
+	return err
+}
+
+// Router dispatches received messages to handlers registered by message type.
+// A handler is a func(*Session, T) error where T is the type Receive returns,
+// an error closes the session with the error as reason.
+// Routes must be registered before the router serves sessions.
+type Router struct {
+	registry map[reflect.Type]bool
+	routes   map[reflect.Type]*route
+	fallback func(*Session, interface{}) error
+	workers  sync.WaitGroup
+	hook     ErrorHook
+}
+
+// NewRouter creates a Router, handlers are checked against registry when it isn't nil.
+func NewRouter(registry TypeRegistry) *Router {
+	router := &Router{
+		routes: make(map[reflect.Type]*route),
+	}
+	if registry != nil {
+		router.registry = make(map[reflect.Type]bool)
+		for _, t := range registry.MessageTypes() {
+			router.registry[t] = true
+		}
+	}
+	return router
+}
+
+// Handle registers fn to run in the receiving goroutine.
+func (router *Router) Handle(fn interface{}) error {
+	_, err := router.addRoute(fn)
+	return err
+}
+
+// HandlePool registers fn to run on its own pool of workers, so slow message
+// types don't hold up the receive loop. Dispatch blocks while queueSize jobs are waiting.
+// A panic in fn closes only the session of the message with a *PanicError reason.
+func (router *Router) HandlePool(fn interface{}, workers, queueSize int) error {
+	if workers <= 0 || queueSize < 0 {
+		return ErrInvalidPool
+	}
+	r, err := router.addRoute(fn)
+	if err != nil {
+		return err
+	}
+
+	r.jobs = make(chan routeJob, queueSize)
+	router.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer router.workers.Done()
+			for job := range r.jobs {
+				router.callPooled(r, job)
+			}
+		}()
+	}
+	return nil
+}
+
+// SetErrorHook sets the hook told about recovered panics of pooled handlers.
+// It must be called before the router serves sessions.
+func (router *Router) SetErrorHook(hook ErrorHook) {
+	router.hook = hook
+}
+
+// callPooled recovers a panicking handler, the worker goes on with the next job.
+func (router *Router) callPooled(r *route, job routeJob) {
+	defer func() {
+		if v := recover(); v != nil {
+			err := &PanicError{v, debug.Stack()}
+			job.session.CloseWithReason(err)
+			if router.hook != nil {
+				router.hook(job.session, err)
+			}
+		}
+	}()
+	if err := r.call(job.session, job.msg); err != nil {
+		job.session.CloseWithReason(err)
+	}
+}
+
+// HandleDefault registers fn for messages without a route.
+func (router *Router) HandleDefault(fn func(*Session, interface{}) error) {
+	router.fallback = fn
+}
+
+func (router *Router) addRoute(fn interface{}) (*route, error) {
+	v := reflect.ValueOf(fn)
+	if !v.IsValid() || v.Kind() != reflect.Func || v.IsNil() {
+		return nil, ErrInvalidHandler
+	}
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.NumOut() != 1 ||
+		t.In(0) != sessionType || t.Out(0) != errorType {
+		return nil, ErrInvalidHandler
+	}
+
+	msgType := t.In(1)
+	if router.registry != nil && !router.registry[msgType] {
+		return nil, ErrNotRegistered
+	}
+	if _, exists := router.routes[msgType]; exists {
+		return nil, ErrDuplicateRoute
+	}
+
+	r := &route{fn: v}
+	router.routes[msgType] = r
+	return r, nil
+}
+
+// Dispatch runs the handler of msg, or queues it when the route has a worker pool.
+func (router *Router) Dispatch(session *Session, msg interface{}) error {
+	r, exists := router.routes[reflect.TypeOf(msg)]
+	if !exists {
+		if router.fallback != nil {
+			return router.fallback(session, msg)
+		}
+		return ErrNoRoute
+	}
+
+	if r.jobs != nil {
+		r.jobs <- routeJob{session, msg}
+		return nil
+	}
+	return r.call(session, msg)
+}
+
+// HandleSession receives and dispatches messages until the session fails, Router is a Handler for Server.Serve.
+func (router *Router) HandleSession(session *Session) {
+	for {
+		msg, err := session.Receive()
+		if err != nil {
+			session.Close()
+			return
+		}
+		if err = router.Dispatch(session, msg); err != nil {
+			session.CloseWithReason(err)
+			return
+		}
+	}
+}
+
+// HandleMessage dispatches msg in the event-driven mode, Router is a MessageHandler for Server.ServeEvents.
+func (router *Router) HandleMessage(session *Session, msg interface{}) {
+	if err := router.Dispatch(session, msg); err != nil {
+		session.CloseWithReason(err)
+	}
+}
+
+// Stop waits for the worker pools to finish the queued messages, nothing may be dispatched afterwards.
+func (router *Router) Stop() {
+	for _, r := range router.routes {
+		if r.jobs != nil {
+			close(r.jobs)
+		}
+	}
+	router.workers.Wait()
+}
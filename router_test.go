@@ -0,0 +1,163 @@
+package link
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type routeAdd struct{ A, B int }
+
+type routeEcho struct{ S string }
+
+type routeRegistry []reflect.Type
+
+func (r routeRegistry) MessageTypes() []reflect.Type { return r }
+
+type listCodec struct {
+	msgs []interface{}
+}
+
+func (c *listCodec) Receive() (interface{}, error) {
+	if len(c.msgs) == 0 {
+		return nil, io.EOF
+	}
+	msg := c.msgs[0]
+	c.msgs = c.msgs[1:]
+	return msg, nil
+}
+
+func (c *listCodec) Send(msg interface{}) error { return nil }
+func (c *listCodec) Close() error               { return nil }
+
+func Test_Router(t *testing.T) {
+	router := NewRouter(routeRegistry{reflect.TypeOf(&routeAdd{}), reflect.TypeOf(&routeEcho{})})
+
+	var sum int
+	if err := router.Handle(func(s *Session, req *routeAdd) error {
+		sum += req.A + req.B
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var echoed int32
+	if err := router.HandlePool(func(s *Session, req *routeEcho) error {
+		atomic.AddInt32(&echoed, 1)
+		return nil
+	}, 2, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := router.Handle(func(s *Session, req *routeAdd) error { return nil }); err != ErrDuplicateRoute {
+		t.Fatalf("duplicate route not rejected: %v", err)
+	}
+	if err := router.Handle(func(s *Session, req *int) error { return nil }); err != ErrNotRegistered {
+		t.Fatalf("unregistered type not rejected: %v", err)
+	}
+	if err := router.Handle(func(req *routeAdd) {}); err != ErrInvalidHandler {
+		t.Fatalf("invalid handler not rejected: %v", err)
+	}
+
+	codec := &listCodec{msgs: []interface{}{
+		&routeAdd{1, 2}, &routeEcho{"a"}, &routeAdd{3, 4}, &routeEcho{"b"}, &routeEcho{"c"},
+	}}
+	session := NewSession(codec, 0)
+	router.HandleSession(session)
+	router.Stop()
+
+	if sum != 10 || atomic.LoadInt32(&echoed) != 3 {
+		t.Fatalf("messages not dispatched: %d, %d", sum, echoed)
+	}
+	if !session.IsClosed() || session.CloseReason() != nil {
+		t.Fatalf("session not closed at EOF: %v", session.CloseReason())
+	}
+}
+
+func Test_RouterError(t *testing.T) {
+	router := NewRouter(nil)
+	failed := errors.New("failed")
+	router.Handle(func(s *Session, req *routeAdd) error { return failed })
+
+	session := NewSession(&listCodec{msgs: []interface{}{&routeEcho{}}}, 0)
+	router.HandleSession(session)
+	if session.CloseReason() != ErrNoRoute {
+		t.Fatalf("close reason not match: %v", session.CloseReason())
+	}
+
+	var fallback interface{}
+	router.HandleDefault(func(s *Session, msg interface{}) error {
+		fallback = msg
+		return nil
+	})
+	session = NewSession(&listCodec{msgs: []interface{}{&routeEcho{"x"}, &routeAdd{}}}, 0)
+	router.HandleSession(session)
+	if e, ok := fallback.(*routeEcho); !ok || e.S != "x" {
+		t.Fatalf("default handler not called: %v", fallback)
+	}
+	if session.CloseReason() != failed {
+		t.Fatalf("close reason not match: %v", session.CloseReason())
+	}
+}
+
+func Test_RouterPoolPanic(t *testing.T) {
+	router := NewRouter(nil)
+
+	var mutex sync.Mutex
+	var errs []error
+	router.SetErrorHook(func(session *Session, err error) {
+		mutex.Lock()
+		errs = append(errs, err)
+		mutex.Unlock()
+	})
+
+	var echoed int32
+	router.HandlePool(func(s *Session, req *routeEcho) error {
+		if req.S == "panic" {
+			panic("handler")
+		}
+		atomic.AddInt32(&echoed, 1)
+		return nil
+	}, 1, 4)
+
+	panicking := NewSession(new(listCodec), 0)
+	router.Dispatch(panicking, &routeEcho{"panic"})
+	session := NewSession(new(listCodec), 0)
+	router.Dispatch(session, &routeEcho{"a"})
+	router.Stop()
+
+	if atomic.LoadInt32(&echoed) != 1 || session.IsClosed() {
+		t.Fatal("worker stopped after a panic")
+	}
+	if e, ok := panicking.CloseReason().(*PanicError); !ok || e.Value != "handler" {
+		t.Fatalf("close reason not match: %v", panicking.CloseReason())
+	}
+	if len(errs) != 1 || errs[0].(*PanicError).Value != "handler" {
+		t.Fatalf("panic not reported: %v", errs)
+	}
+}
+
+func Test_RouterInvalid(t *testing.T) {
+	router := NewRouter(nil)
+	handler := func(s *Session, req *routeEcho) error { return nil }
+
+	if err := router.HandlePool(handler, 0, 4); err != ErrInvalidPool {
+		t.Fatalf("pool without workers not rejected: %v", err)
+	}
+	if err := router.HandlePool(handler, 1, -1); err != ErrInvalidPool {
+		t.Fatalf("negative queue size not rejected: %v", err)
+	}
+	if err := router.Handle(nil); err != ErrInvalidHandler {
+		t.Fatalf("nil handler not rejected: %v", err)
+	}
+	var nilFunc func(*Session, *routeEcho) error
+	if err := router.HandlePool(nilFunc, 1, 4); err != ErrInvalidHandler {
+		t.Fatalf("nil func not rejected: %v", err)
+	}
+	if err := router.Handle(handler); err != nil {
+		t.Fatal(err)
+	}
+}
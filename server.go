@@ -2,6 +2,8 @@ package link
 
 import (
 	"net"
+	"runtime/debug"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,6 +12,35 @@ type Server struct {
 	listener     net.Listener
 	protocol     Protocol
 	sendChanSize int
+	resume       *resumeRegistry
+
+	sessionLimit *RateLimit
+	globalLimit  *RateLimit
+	global       *RateLimiter
+
+	sendInterceptors    []SendInterceptor
+	receiveInterceptors []ReceiveInterceptor
+
+	errorHook    ErrorHook
+	events       atomic.Value
+}
+
+// ErrorHook is told about a recovered handler panic, session is nil when the
+// panic happened before the session was created.
+type ErrorHook func(session *Session, err error)
+
+// handleSession runs the handler, a panic closes only this session with a *PanicError reason.
+func handleSession(handler Handler, session *Session, hook ErrorHook) {
+	defer func() {
+		if v := recover(); v != nil {
+			err := &PanicError{v, debug.Stack()}
+			session.CloseWithReason(err)
+			if hook != nil {
+				hook(session, err)
+			}
+		}
+	}()
+	handler.HandleSession(session)
 }
 
 
@@ -26,7 +57,57 @@ func (server *Server) Listener() net.Listener {
 	return server.listener
 }
 
-func (server *Server) Serve(handler Handler) error {
+// EnableResume makes new sessions resumable. The client reattaches to the same
+// session with its resume token within timeout after a disconnect, up to
+// bufferSize unacknowledged messages are kept for replay. Send returns the
+// error of a failed write, the message is still replayed after reattaching.
+// It must be called before Serve and the client must enable resume too.
+func (server *Server) EnableResume(bufferSize int, timeout time.Duration) {
+	server.resume = newResumeRegistry(bufferSize, timeout)
+}
+
+// SetRateLimit polices inbound traffic of new sessions with a limiter per
+// session and a global limiter shared by all sessions, nil disables either one.
+// It must be called before Serve.
+func (server *Server) SetRateLimit(session, global *RateLimit) {
+	server.sessionLimit = session
+	server.globalLimit = global
+	server.global = nil
+	if global != nil {
+		server.global = NewRateLimiter(*global)
+	}
+}
+
+func (server *Server) setRateLimit(session *Session) {
+	var limiters []*RateLimiter
+	if server.sessionLimit != nil {
+		limiters = append(limiters, NewRateLimiter(*server.sessionLimit))
+	}
+	if server.global != nil {
+		limiters = append(limiters, server.global)
+	}
+	if limiters != nil {
+		session.SetRateLimit(limiters...)
+	}
+}
+
+// UseSend appends interceptors around every codec send of new sessions.
+func (server *Server) UseSend(interceptors ...SendInterceptor) {
+	server.sendInterceptors = append(server.sendInterceptors, interceptors...)
+}
+
+// UseReceive appends interceptors around every codec receive of new sessions.
+func (server *Server) UseReceive(interceptors ...ReceiveInterceptor) {
+	server.receiveInterceptors = append(server.receiveInterceptors, interceptors...)
+}
+
+// SetErrorHook sets the hook told about recovered handler panics.
+func (server *Server) SetErrorHook(hook ErrorHook) {
+	server.errorHook = hook
+}
+
+// accept retries temporary errors with backoff.
+func (server *Server) accept() (net.Conn, error) {
 	var tempDelay time.Duration
 
 	for {
@@ -46,18 +127,121 @@ func (server *Server) Serve(handler Handler) error {
 				continue
 			}
 
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+func (server *Server) Serve(handler Handler) error {
+	for {
+		conn, err := server.accept()
+		if err != nil {
 			return err
 		}
 
-		go func() {
-			codec, err := server.protocol.NewCodec(conn)
-			if err != nil {
-				conn.Close()
-				return
+		go server.serveConn(conn, handler)
+	}
+}
+
+// serveConn serves conn with a goroutine of its own.
+func (server *Server) serveConn(conn net.Conn, handler Handler) {
+	defer func() {
+		if v := recover(); v != nil {
+			conn.Close()
+			if server.errorHook != nil {
+				server.errorHook(nil, &PanicError{v, debug.Stack()})
 			}
-			session := server.manager.NewSession(codec, server.sendChanSize)
-			handler.HandleSession(session)
-		}()
+		}
+	}()
+
+	if server.resume != nil {
+		server.serveResumable(conn, handler)
+		return
+	}
+	if session := server.createSession(conn); session != nil {
+		handleSession(handler, session, server.errorHook)
+	}
+}
+
+// createSession returns nil and closes conn when the codec can't be created.
+func (server *Server) createSession(conn net.Conn) *Session {
+	conn, meter := meterConn(conn)
+	codec, err := server.protocol.NewCodec(conn)
+	if err != nil {
+		conn.Close()
+		return nil
+	}
+	session := server.manager.NewSession(codec, server.sendChanSize)
+	session.meter = meter
+	server.setRateLimit(session)
+	session.SetInterceptors(server.sendInterceptors, server.receiveInterceptors)
+	return session
+}
+
+func (server *Server) serveResumable(conn net.Conn, handler Handler) {
+	conn.SetDeadline(time.Now().Add(server.resume.handshakeTimeout))
+	token, received, err := readResumeHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if token != (ResumeToken{}) {
+		server.resumeSession(conn, token, received)
+		return
+	}
+
+	token, err = newResumeToken()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if err = writeResumeHandshake(conn, token, 0); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	conn, meter := meterConn(conn)
+	codec, err := server.protocol.NewCodec(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	resume := newSessionResume(codec, token, server.resume.bufferSize, server.resume.timeout, nil)
+	session := server.manager.manage(newSession(codec, server.sendChanSize, resume))
+	session.meter = meter
+	server.setRateLimit(session)
+	session.SetInterceptors(server.sendInterceptors, server.receiveInterceptors)
+	server.resume.put(session)
+	handleSession(handler, session, server.errorHook)
+}
+
+func (server *Server) resumeSession(conn net.Conn, token ResumeToken, received uint64) {
+	session := server.resume.get(token)
+	if session == nil {
+		writeResumeHandshake(conn, ResumeToken{}, 0)
+		conn.Close()
+		return
+	}
+
+	// the old connection may still look alive, it is detached before the
+	// count is sent and what arrives on it afterwards is replayed by the peer
+	ownReceived := session.resume.takeOver(session)
+	if err := writeResumeHandshake(conn, token, ownReceived); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	conn = &meteredConn{conn, session.meter}
+	codec, err := server.protocol.NewCodec(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if err = session.resume.attach(session, codec, received); err != nil {
+		codec.Close()
 	}
 }
 
@@ -65,7 +249,18 @@ func (server *Server) GetSession(sessionID uint64) *Session {
 	return server.manager.GetSession(sessionID)
 }
 
+func (server *Server) Broadcast(msg interface{}, filter func(*Session) bool) []BroadcastError {
+	return server.manager.Broadcast(msg, filter)
+}
+
+func (server *Server) Multicast(ids []uint64, msg interface{}) []BroadcastError {
+	return server.manager.Multicast(ids, msg)
+}
+
 func (server *Server) Stop() {
 	server.listener.Close()
+	if loop, ok := server.events.Load().(*eventLoop); ok {
+		loop.stop()
+	}
 	server.manager.Dispose()
 }
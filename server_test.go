@@ -0,0 +1,63 @@
+package link
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_ServerRecoverPanic(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(l, uint64Protocol{}, 0)
+	defer server.Stop()
+
+	hooked := make(chan *Session, 1)
+	server.SetErrorHook(func(session *Session, err error) {
+		if _, ok := err.(*PanicError); !ok {
+			t.Errorf("error not a panic: %v", err)
+		}
+		hooked <- session
+	})
+	go server.Serve(HandlerFunc(func(session *Session) {
+		msg, err := session.Receive()
+		if err != nil {
+			return
+		}
+		if msg.(uint64) == 0 {
+			panic("bad request")
+		}
+		session.Send(msg)
+	}))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, _ := uint64Protocol{}.NewCodec(conn)
+	bad.Send(uint64(0))
+
+	select {
+	case session := <-hooked:
+		if !session.IsClosed() {
+			t.Fatal("panicking session not closed")
+		}
+		if _, ok := session.CloseReason().(*PanicError); !ok {
+			t.Fatalf("close reason not a panic: %v", session.CloseReason())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("error hook not called")
+	}
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, _ := uint64Protocol{}.NewCodec(conn)
+	good.Send(uint64(1))
+	if msg, err := good.Receive(); err != nil || msg.(uint64) != 1 {
+		t.Fatalf("server stopped serving after a panic: %v, %v", msg, err)
+	}
+}
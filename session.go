@@ -5,6 +5,7 @@ import (
 	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var SessionClosedError = errors.New("Session Closed")
@@ -15,28 +16,54 @@ var globalSessionId uint64
 type Session struct {
 	id             uint64
 	codec          Codec
-	sendChan       chan interface{}
+	sendChans      [numPriorities]chan interface{}
+	laneWeights    atomic.Value
+	laneCredits    [numPriorities]int
+
+	// State holds user attributes, it survives a resumed reconnect.
+	State          interface{}
+	resume         *sessionResume
 
 	closeFlag      int32
 	closeChan      chan int
+	closeReason    error
 
 	closeMutex     sync.Mutex
 	closeCallbacks *list.List
 
 	readSpeed      *SpeedCounter
 	writeSpeed     *SpeedCounter
+
+	batchDelay     time.Duration
+	batchBytes     int
+
+	limiters       []*RateLimiter
+	meter          *byteMeter
+
+	sendFunc       SendFunc
+	receiveFunc    ReceiveFunc
+	sendInterceptors []SendInterceptor
+	// writeErr is the codec error of the async send loop, only the loop uses it.
+	writeErr       error
 }
 
 func NewSession(codec Codec, sendChanSize int) *Session {
+	return newSession(codec, sendChanSize, nil)
+}
+
+func newSession(codec Codec, sendChanSize int, resume *sessionResume) *Session {
 	session := &Session{
 		codec:     codec,
 		closeChan: make(chan int),
 		id:        atomic.AddUint64(&globalSessionId, 1),
 		readSpeed: NewSpeedCounter(),
 		writeSpeed:NewSpeedCounter(),
+		resume:    resume,
 	}
 	if sendChanSize > 0 {
-		session.sendChan = make(chan interface{}, sendChanSize)
+		for i := range session.sendChans {
+			session.sendChans[i] = make(chan interface{}, sendChanSize)
+		}
 		go session.sendLoop()
 	}
 	return session
@@ -51,8 +78,17 @@ func (session *Session) IsClosed() bool {
 }
 
 func (session *Session) Close() error {
+	return session.CloseWithReason(nil)
+}
+
+// CloseWithReason closes the session and records why, see CloseReason.
+func (session *Session) CloseWithReason(reason error) error {
 	if atomic.CompareAndSwapInt32(&session.closeFlag, 0, 1) {
-		err := session.codec.Close()
+		session.closeMutex.Lock()
+		session.closeReason = reason
+		session.closeMutex.Unlock()
+
+		err := session.Codec().Close()
 		close(session.closeChan)
 		session.invokeCloseCallbacks()
 		return err
@@ -60,43 +96,248 @@ func (session *Session) Close() error {
 	return SessionClosedError
 }
 
+// CloseReason returns the reason given to CloseWithReason, it is nil for a plain Close.
+func (session *Session) CloseReason() error {
+	session.closeMutex.Lock()
+	defer session.closeMutex.Unlock()
+	return session.closeReason
+}
+
 func (session *Session) Codec() Codec {
+	if session.resume != nil {
+		return session.resume.currentCodec()
+	}
 	return session.codec
 }
 
+func (session *Session) Resumable() bool {
+	return session.resume != nil
+}
+
 func (session *Session) Receive() (interface{}, error) {
 	session.readSpeed.Add(1)
-	msg, err := session.codec.Receive()
-	return msg, err
+	for {
+		msg, err := session.receiveMsg()
+		if err != nil || session.limiters == nil {
+			return msg, err
+		}
+
+		ok, err := session.allow()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return msg, nil
+		}
+	}
+}
+
+func (session *Session) receiveMsg() (interface{}, error) {
+	if session.receiveFunc != nil {
+		return session.receiveFunc()
+	}
+	return session.receive()
+}
+
+func (session *Session) receive() (interface{}, error) {
+	if session.resume != nil {
+		return session.resume.receive(session)
+	}
+	return session.codec.Receive()
+}
+
+func (session *Session) sendMsg(msg interface{}) error {
+	if session.sendFunc != nil {
+		return session.sendFunc(msg)
+	}
+	return session.send(msg)
+}
+
+func (session *Session) send(msg interface{}) (err error) {
+	if session.resume != nil {
+		err = session.resume.send(session, msg)
+	} else {
+		err = session.codec.Send(msg)
+	}
+	if err != nil && session.sendChans[PriorityNormal] != nil {
+		session.writeErr = err
+	}
+	return err
+}
+
+// SetBatch tunes how the async send loop coalesces writes when the codec is a BatchCodec.
+// The loop always drains the send channel before it flushes, maxBytes flushes early
+// once that many bytes are buffered and maxDelay waits up to that long for more
+// messages before flushing. It must be called before the first Send.
+func (session *Session) SetBatch(maxDelay time.Duration, maxBytes int) {
+	session.batchDelay = maxDelay
+	session.batchBytes = maxBytes
 }
 
 func (session *Session) sendLoop() {
 	defer session.Close()
 	for {
-		select {
-		case msg, ok := <-session.sendChan:
-			if !ok || session.codec.Send(msg) != nil {
+		msg, _, err := session.waitMessage(nil)
+		if err != nil {
+			return
+		}
+		// an interceptor rejecting a message only drops that message, a failed
+		// write ends the loop. A resumable session keeps the message and sends it
+		// after reattaching.
+		session.sendBatch(msg)
+		if session.writeErr != nil {
+			if session.resume == nil || session.IsClosed() {
 				return
 			}
-		case <-session.closeChan:
-			return
+			session.writeErr = nil
 		}
 	}
 }
 
+func (session *Session) sendBatch(msg interface{}) {
+	codec, ok := session.codec.(BatchCodec)
+	if !ok || session.resume != nil {
+		session.sendMsg(msg)
+		return
+	}
+
+	b := &batchSender{session: session, codec: codec}
+	b.send = b.enqueue
+	if session.sendInterceptors != nil {
+		b.nested = true
+		b.send = chainSend(session, session.sendInterceptors, b.enqueue)
+	}
+	defer func() {
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+	}()
+
+	b.send(msg)
+	b.drain()
+}
+
+// batchSender coalesces the queued messages into one Flush. With send
+// interceptors every Enqueue goes on with the rest of the batch, so the
+// interceptors of a message return after the Flush and see its error.
+type batchSender struct {
+	session  *Session
+	codec    BatchCodec
+	send     SendFunc
+	nested   bool
+	count    int
+	timer    *time.Timer
+	done     bool
+	flushErr error
+}
+
+func (b *batchSender) enqueue(msg interface{}) error {
+	if err := b.codec.Enqueue(msg); err != nil {
+		b.session.writeErr = err
+		return err
+	}
+	b.count++
+	if !b.nested {
+		return nil
+	}
+	b.drain()
+	return b.flushErr
+}
+
+func (b *batchSender) drain() {
+	for !b.done {
+		if msg, ok := b.next(); ok {
+			b.send(msg)
+		}
+	}
+}
+
+// next returns the next message of the batch, or flushes and ends the batch.
+// A nested batch ends at an early flush or a full send channel, which bounds
+// the depth of the interceptor calls.
+func (b *batchSender) next() (interface{}, bool) {
+	session, codec := b.session, b.codec
+	if session.writeErr != nil {
+		b.end(session.writeErr)
+		return nil, false
+	}
+
+	if session.batchBytes > 0 && codec.Buffered() >= session.batchBytes {
+		if b.nested {
+			b.flush()
+			return nil, false
+		}
+		if err := codec.Flush(); err != nil {
+			session.writeErr = err
+			b.end(err)
+			return nil, false
+		}
+	}
+	if b.nested && b.count >= cap(session.sendChans[PriorityNormal]) {
+		b.flush()
+		return nil, false
+	}
+
+	if msg, ok := session.pollMessage(); ok {
+		return msg, true
+	}
+
+	if session.batchDelay <= 0 || codec.Buffered() == 0 {
+		b.flush()
+		return nil, false
+	}
+	if b.timer == nil {
+		b.timer = time.NewTimer(session.batchDelay)
+	}
+
+	msg, ok, err := session.waitMessage(b.timer.C)
+	if err != nil {
+		b.end(err)
+		return nil, false
+	}
+	if !ok {
+		b.flush()
+		return nil, false
+	}
+	return msg, true
+}
+
+func (b *batchSender) flush() {
+	err := b.codec.Flush()
+	if err != nil {
+		b.session.writeErr = err
+	}
+	b.end(err)
+}
+
+func (b *batchSender) end(err error) {
+	b.done = true
+	b.flushErr = err
+}
+
 func (session *Session) Send(msg interface{}) (err error) {
+	return session.SendPriority(msg, PriorityNormal)
+}
+
+// SendPriority queues msg on the lane of priority, so it is not stuck behind
+// messages of lower priority. Sync sessions send it right away.
+func (session *Session) SendPriority(msg interface{}, priority Priority) (err error) {
 
 	if session.IsClosed() {
 		return SessionClosedError
 	}
+	if priority < 0 || priority >= numPriorities {
+		return ErrInvalidPriority
+	}
 
 	session.writeSpeed.Add(1)
 
-	if session.sendChan == nil {
-		return session.codec.Send(msg)
+	sendChan := session.sendChans[priority]
+	if sendChan == nil {
+		return session.sendMsg(msg)
 	}
 	select {
-	case session.sendChan <- msg:
+	case sendChan <- msg:
 		return nil
 	default:
 		return SessionBlockedError
@@ -104,7 +345,7 @@ func (session *Session) Send(msg interface{}) (err error) {
 }
 
 func (session *Session) GetSpeed() (uint64) {
-	return uint64(session.readSpeed.Speed + session.writeSpeed.Speed)
+	return uint64(session.readSpeed.Current() + session.writeSpeed.Current())
 }
 
 type closeCallbackFunc func(*Session)
@@ -1,7 +1,9 @@
 package link
 
 import (
+	"sync"
 	"testing"
+	"time"
 )
 
 func Benchmark_BytesToInterface(b *testing.B) {
@@ -39,3 +41,104 @@ func Benchmark_InterfaceToPointer(b *testing.B) {
 	}
 	_ = a
 }
+
+// batchTestCodec signals blocked when the first Enqueue waits for release
+// and flushed after every Flush that writes something.
+type batchTestCodec struct {
+	sync.Mutex
+	enqueued []interface{}
+	buffered int
+	flushes  int
+	blocked  chan struct{}
+	release  chan struct{}
+	flushed  chan struct{}
+}
+
+func newBatchTestCodec() *batchTestCodec {
+	return &batchTestCodec{
+		blocked: make(chan struct{}, 1),
+		release: make(chan struct{}),
+		flushed: make(chan struct{}, 100),
+	}
+}
+
+func (c *batchTestCodec) Receive() (interface{}, error) { return nil, nil }
+func (c *batchTestCodec) Close() error                  { return nil }
+
+func (c *batchTestCodec) Send(msg interface{}) error {
+	c.Enqueue(msg)
+	return c.Flush()
+}
+
+func (c *batchTestCodec) Enqueue(msg interface{}) error {
+	select {
+	case c.blocked <- struct{}{}:
+	default:
+	}
+	<-c.release
+	c.Lock()
+	defer c.Unlock()
+	c.enqueued = append(c.enqueued, msg)
+	c.buffered++
+	return nil
+}
+
+func (c *batchTestCodec) Buffered() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.buffered
+}
+
+func (c *batchTestCodec) Flush() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.buffered == 0 {
+		return nil
+	}
+	c.buffered = 0
+	c.flushes++
+	c.flushed <- struct{}{}
+	return nil
+}
+
+// waitFlushed waits until n messages are flushed and returns them.
+func (c *batchTestCodec) waitFlushed(t *testing.T, n int) []interface{} {
+	for {
+		c.Lock()
+		flushed := c.enqueued[:len(c.enqueued)-c.buffered]
+		c.Unlock()
+		if len(flushed) >= n {
+			return flushed
+		}
+		select {
+		case <-c.flushed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d messages flushed", len(flushed), n)
+		}
+	}
+}
+
+func Test_SessionBatch(t *testing.T) {
+	codec := newBatchTestCodec()
+	session := NewSession(codec, 100)
+	// only the size flushes, the delay is never reached
+	session.SetBatch(time.Minute, 11)
+	defer session.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := session.Send(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-codec.blocked
+	close(codec.release)
+	// queued after the loop drained the channel, still in the same batch
+	session.Send(10)
+	codec.waitFlushed(t, 11)
+
+	codec.Lock()
+	defer codec.Unlock()
+	if len(codec.enqueued) != 11 || codec.flushes != 1 {
+		t.Fatalf("batch not coalesced: %d messages, %d flushes", len(codec.enqueued), codec.flushes)
+	}
+}